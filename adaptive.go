@@ -0,0 +1,61 @@
+package kv
+
+import (
+	"bufio"
+	"time"
+)
+
+// Bounds and parameters of WithAdaptiveBuffer.
+const (
+	adaptiveMinBuffer = 4 << 10 // the bufio default
+	adaptiveMaxBuffer = 1 << 20
+	adaptiveEvery     = 256                    // records between adjustments
+	adaptiveRecords   = 32                     // records the buffer should fit, for throughput
+	adaptiveWindow    = 100 * time.Millisecond // writes the buffer may hold at most, for the data at risk
+)
+
+// bufferTuner gathers the record sizes and the write rate for WithAdaptiveBuffer.
+type bufferTuner struct {
+	records int
+	bytes   int64
+	since   time.Time
+}
+
+// tune counts a record of n bytes and, every adaptiveEvery records, sizes
+// the buffer for the records written since the last time.
+func (j *journal) tune(n int) {
+	t := &j.tuner
+	if t.since.IsZero() {
+		t.since = time.Now()
+	}
+	t.records++
+	t.bytes += int64(n)
+	if t.records < adaptiveEvery {
+		return
+	}
+	elapsed := time.Since(t.since).Seconds()
+	size := bufferTarget(t.bytes/int64(t.records), float64(t.bytes)/max(elapsed, 1e-9))
+	*t = bufferTuner{}
+	if size == j.bufWriter.Size() {
+		return
+	}
+	// a failed flush shows up on the next one, just keep the buffer.
+	if j.bufWriter.Flush() != nil {
+		return
+	}
+	j.bufWriter = bufio.NewWriterSize(j.fh, size)
+}
+
+// bufferTarget returns the buffer size for records of avg bytes written at
+// rate bytes a second: room for adaptiveRecords of them, but no more than
+// adaptiveWindow worth of writes, so a slow writer doesn't leave records
+// in the buffer for long. It's a power of two within the bounds, so the
+// buffer isn't replaced over small changes.
+func bufferTarget(avg int64, rate float64) int {
+	want := min(float64(avg*adaptiveRecords), rate*adaptiveWindow.Seconds())
+	size := adaptiveMinBuffer
+	for float64(size) < want && size < adaptiveMaxBuffer {
+		size *= 2
+	}
+	return size
+}
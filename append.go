@@ -0,0 +1,49 @@
+package kv
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Append appends the items to the []any stored under key, all under the
+// same lock, and returns the new length. A missing key starts out as an
+// empty slice. It fails with ErrWrongType if the key holds anything but a
+// []any, including slices of other types. The stored slice is replaced by
+// a copy, so slices handed out earlier by Get are left as they were.
+func (kv *KV) Append(key string, items ...any) (int, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	err := kv.beforeWrite(1)
+	if err != nil {
+		return 0, err
+	}
+	kv.mu.Lock()
+	var list []any
+	current, ok := kv.memory[key]
+	if ok && !kv.expired(key) {
+		current, err = unspill(current)
+		if err != nil {
+			kv.unlock()
+			return 0, err
+		}
+		list, ok = current.([]any)
+		if !ok {
+			kv.unlock()
+			return 0, fmt.Errorf("%w: '%s' is %T, not []any", ErrWrongType, key, current)
+		}
+	}
+	grown := make([]any, 0, len(list)+len(items))
+	grown = append(append(grown, list...), items...)
+	err = kv.setLocked(key, grown)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return 0, err
+	}
+	err = kv.settle(seq, slog.String("op", "append"), slog.String("key", key))
+	if err != nil {
+		return 0, err
+	}
+	return len(grown), nil
+}
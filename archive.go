@@ -0,0 +1,101 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveTimeFormat is the timestamp appended to the name of an archived
+// journal. It sorts in time order.
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+// archive copies the first off bytes of the journal, the records a
+// coalesce is about to drop, into the archive directory, and prunes the
+// archives past the retention. The journal must be flushed.
+func (j *journal) archive(off int64) error {
+	err := os.MkdirAll(j.cfg.archiveDir, 0o777)
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	src, err := os.Open(j.name)
+	if err != nil {
+		return fmt.Errorf("archive: open: %w", err)
+	}
+	defer src.Close()
+	name := filepath.Join(j.cfg.archiveDir, filepath.Base(j.name)+"."+time.Now().UTC().Format(archiveTimeFormat))
+	fh, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, j.cfg.mode)
+	if err != nil {
+		return fmt.Errorf("archive: create: %w", err)
+	}
+	_, err = io.CopyN(fh, src, off)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(name)
+		return fmt.Errorf("archive: copy: %w", err)
+	}
+	err = fh.Close()
+	if err != nil {
+		os.Remove(name)
+		return fmt.Errorf("archive: close: %w", err)
+	}
+	j.cfg.log().Info("journal archived", slog.String("op", "archive"), slog.String("file", name), slog.Int64("size", off))
+	// failing to prune shouldn't fail the coalesce, it's retried next time.
+	err = j.pruneArchive()
+	if err != nil {
+		j.cfg.log().Warn("pruning the journal archive failed", slog.String("op", "archive"), slog.Any("error", err))
+	}
+	return nil
+}
+
+// pruneArchive removes the archived journals beyond the retention count and
+// those older than the retention age.
+func (j *journal) pruneArchive() error {
+	if j.cfg.archiveKeep <= 0 && j.cfg.archiveMaxAge <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(j.cfg.archiveDir)
+	if err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+	prefix := filepath.Base(j.name) + "."
+	type archived struct {
+		name string
+		time time.Time
+	}
+	var archives []archived
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		t, err := time.Parse(archiveTimeFormat, strings.TrimPrefix(e.Name(), prefix))
+		if err != nil {
+			// not one of ours.
+			continue
+		}
+		archives = append(archives, archived{name: e.Name(), time: t})
+	}
+	// newest first:
+	sort.Slice(archives, func(a, b int) bool { return archives[a].time.After(archives[b].time) })
+	now := time.Now()
+	for i, a := range archives {
+		tooMany := j.cfg.archiveKeep > 0 && i >= j.cfg.archiveKeep
+		tooOld := j.cfg.archiveMaxAge > 0 && now.Sub(a.time) > j.cfg.archiveMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = os.Remove(filepath.Join(j.cfg.archiveDir, a.name))
+		if err != nil {
+			return fmt.Errorf("remove archived journal: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrCoalesceInProgress = errors.New("coalesce already in progress")
+)
+
+// CoalesceAsync coalesces the journal into the dump in the background and
+// returns a channel that receives the result. Unlike Coalesce, the store
+// isn't locked while the dump is written: the map is shared like a ReadTx
+// and writes carry on into the journal. Once the dump is in place, the
+// records journaled in the meantime are kept and the rest dropped.
+// Only one CoalesceAsync runs at the time, the channel of a second call
+// receives ErrCoalesceInProgress.
+func (kv *KV) CoalesceAsync() <-chan error {
+	result := make(chan error, 1)
+	if !kv.ready.Load() {
+		result <- ErrClosed
+		return result
+	}
+	if kv.readOnly {
+		result <- ErrReadOnly
+		return result
+	}
+	if !kv.asyncCoalescing.CompareAndSwap(false, true) {
+		result <- ErrCoalesceInProgress
+		return result
+	}
+	go func() {
+		defer kv.asyncCoalescing.Store(false)
+		var err error
+		kv.guard("async coalesce", func() {
+			err = kv.coalesceSnapshot()
+		})
+		if !errors.Is(err, ErrNotReady) {
+			kv.mu.Lock()
+			kv.coalesceErr = err
+			kv.mu.Unlock()
+		}
+		result <- err
+	}()
+	return result
+}
+
+// coalesceSnapshot writes a snapshot of the map to the dump without holding
+// the lock, then drops the journal records the snapshot covers.
+func (kv *KV) coalesceSnapshot() error {
+	span := kv.startSpan("kv.CoalesceAsync")
+	defer span.End()
+	start := time.Now()
+	defer func() {
+		kv.logger.Info("coalesce done", slog.String("op", "coalesce async"), slog.Duration("duration", time.Since(start)))
+	}()
+	// expired keys aren't worth persisting, see Compact.
+	kv.sweep()
+	// Close waits for coalesceMu, so once the store is found ready below the
+	// journal stays open until we're done, even if Close is called meanwhile.
+	kv.coalesceMu.Lock()
+	defer kv.coalesceMu.Unlock()
+	kv.mu.Lock()
+	if !kv.ready.Load() {
+		kv.mu.Unlock()
+		return ErrClosed
+	}
+	if !kv.dirty {
+		kv.mu.Unlock()
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return nil
+	}
+	// everything journaled up to mark is in the snapshot.
+	err := kv.journal.flush()
+	mark := kv.journal.size()
+	if err != nil {
+		kv.unlock()
+		span.RecordError(err)
+		return fmt.Errorf("flushing journal: %w", err)
+	}
+	markSeq := kv.journal.seq
+	kv.readers++
+	tx := &ReadTx{kv: kv, memory: kv.memory, gen: kv.gen}
+	expires := maps.Clone(kv.expires)
+	ops := kv.opsSinceCoalesce.Load()
+	kv.unlock()
+
+	tmp := kv.fileName + ".tmp"
+	err = writeDumpFile(tmp, tx.memory, expires, kv.dumpCfg)
+	_ = tx.Close()
+	if err != nil {
+		os.Remove(tmp)
+		span.RecordError(err)
+		return fmt.Errorf("dumping memory: %w", err)
+	}
+
+	// nothing else empties the journal while we hold coalesceMu, and Close
+	// is waiting for it, so the journal is still there to cut.
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	// a crash between the rename and dropping the records is harmless, the
+	// records are replayed on top of the dump that already holds them.
+	err = renameFile(tmp, kv.fileName, kv.dumpCfg.dirSync)
+	if err != nil {
+		os.Remove(tmp)
+		span.RecordError(err)
+		return fmt.Errorf("renaming dump: %w", err)
+	}
+	size := kv.journal.size()
+	err = kv.journal.dropBefore(mark, markSeq)
+	if err != nil {
+		span.RecordError(err)
+		return kv.walFailed(fmt.Errorf("dropping coalesced records: %w", err))
+	}
+	// only the records written since the snapshot are left.
+	kv.dirty = size > mark
+	kv.opsSinceCoalesce.Add(-ops)
+	kv.coalesces++
+	kv.walDrained.Broadcast()
+	kv.recordCoalesce(start, size)
+	return nil
+}
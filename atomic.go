@@ -0,0 +1,136 @@
+package kv
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+)
+
+// equal compares two values with the function given to WithEqualityFunc,
+// or with reflect.DeepEqual if there is none. DeepEqual works on any type,
+// so, unlike ==, it doesn't panic on slices and maps.
+func (kv *KV) equal(a, b any) bool {
+	if kv.equality != nil {
+		return kv.equality(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// CompareAndSwap sets the key to new if its current value is equal to old.
+// It returns false, and changes nothing, if the key is missing or holds
+// another value. See AtomicUpdate for how values are compared.
+func (kv *KV) CompareAndSwap(key string, old, new any) (bool, error) {
+	return kv.AtomicUpdate(map[string]any{key: old}, map[string]any{key: new}, nil)
+}
+
+// CompareAndDelete deletes the key if its current value is equal to old,
+// such as to release a lock only while still holding it. It returns false,
+// and changes nothing, if the key is missing or holds another value. See
+// AtomicUpdate for how values are compared.
+func (kv *KV) CompareAndDelete(key string, old any) (bool, error) {
+	return kv.AtomicUpdate(map[string]any{key: old}, nil, []string{key})
+}
+
+// AtomicUpdate applies the writes and the deletes if, and only if, every key
+// in conds is present with an equal value. Values are compared with
+// reflect.DeepEqual, unless the store has been given another function with
+// WithEqualityFunc. The check and the changes happen
+// under one lock and the changes are journaled together, like a Batch.
+// It returns false, and changes nothing, if a condition doesn't hold.
+func (kv *KV) AtomicUpdate(conds map[string]any, writes map[string]any, deletes []string) (bool, error) {
+	if !kv.ready.Load() {
+		return false, ErrClosed
+	}
+	b := &Batch{}
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.Set(key, writes[key])
+	}
+	for _, key := range deletes {
+		b.Delete(key)
+	}
+	err := kv.checkBatch(b)
+	if err != nil {
+		return false, err
+	}
+	err = kv.beforeWrite(b.Len())
+	if err != nil {
+		return false, err
+	}
+	kv.mu.Lock()
+	for key, want := range conds {
+		got, ok := kv.memory[key]
+		if !ok || kv.expired(key) {
+			kv.unlock()
+			return false, nil
+		}
+		got, err = unspill(got)
+		if err != nil {
+			kv.unlock()
+			return false, err
+		}
+		if !kv.equal(got, want) {
+			kv.unlock()
+			return false, nil
+		}
+	}
+	if b.Len() > 0 {
+		err = kv.writeLocked(b)
+	}
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return false, err
+	}
+	err = kv.settle(seq, slog.String("op", "atomic update"))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetAndDelete removes the key, returning the value it held, under one
+// lock, so of several callers claiming the same key only one gets it, such
+// as consumers taking items off a work queue. The delete is journaled like
+// an Unset. It returns false if the key is missing or has expired.
+func (kv *KV) GetAndDelete(key string) (any, bool, error) {
+	if !kv.ready.Load() {
+		return nil, false, ErrClosed
+	}
+	kv.audit("unset", key)
+	err := kv.beforeWrite(1)
+	if err != nil {
+		return nil, false, err
+	}
+	kv.mu.Lock()
+	stored, ok := kv.memory[key]
+	if ok && kv.expired(key) {
+		err = kv.expireLocked(key)
+		if err != nil {
+			kv.logger.Error("expiring failed", slog.String("op", "expire"), slog.String("key", key), slog.Any("error", err))
+		}
+		ok = false
+	}
+	if !ok {
+		kv.unlock()
+		return nil, false, nil
+	}
+	value, err := unspill(stored)
+	if err == nil {
+		err = kv.unsetLocked(key)
+	}
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	err = kv.settle(seq, slog.String("op", "unset"), slog.String("key", key))
+	if err != nil {
+		return value, true, err
+	}
+	return value, true, nil
+}
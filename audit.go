@@ -0,0 +1,9 @@
+package kv
+
+// audit reports an access to the WithAuditHook hook, if there is one.
+// It must be called without holding the lock.
+func (kv *KV) audit(op, key string) {
+	if kv.auditHook != nil {
+		kv.auditHook(op, key)
+	}
+}
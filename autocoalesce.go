@@ -0,0 +1,40 @@
+package kv
+
+import "os"
+
+// ratioFloor is the smallest dump size the WithCoalesceRatio ratio is
+// applied to, so a nearly empty store isn't coalesced on every write.
+const ratioFloor = 64 << 10
+
+// countOp counts a mutation towards the automatic coalesce, and starts one
+// in the background when enough have piled up. It assumes kv is locked.
+func (kv *KV) countOp() {
+	if kv.coalesceEveryOps <= 0 {
+		return
+	}
+	if kv.opsSinceCoalesce.Add(1) < int64(kv.coalesceEveryOps) {
+		return
+	}
+	kv.coalesceInBackground()
+}
+
+// checkRatio starts a coalesce in the background once the journal has
+// outgrown the dump by the WithCoalesceRatio factor. It assumes kv is locked.
+func (kv *KV) checkRatio() {
+	if kv.coalesceRatio <= 0 {
+		return
+	}
+	if float64(kv.journal.size()) > kv.coalesceRatio*float64(max(kv.dumpSize, ratioFloor)) {
+		kv.coalesceInBackground()
+	}
+}
+
+// statDump records the size of the dump for checkRatio. It assumes kv is
+// locked, and is called whenever a new dump has been written.
+func (kv *KV) statDump() {
+	fi, err := os.Stat(kv.fileName)
+	if err != nil {
+		return
+	}
+	kv.dumpSize = fi.Size()
+}
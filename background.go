@@ -0,0 +1,38 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+var (
+	ErrBackgroundPanic = errors.New("background task panicked")
+)
+
+// guard runs one iteration of a background task. A panic is recovered,
+// logged and recorded, so it doesn't take the process down, and the task
+// carries on with its next iteration.
+func (kv *KV) guard(task string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("%w: %s: %v", ErrBackgroundPanic, task, r)
+			kv.logger.Error("background task panicked", slog.String("op", task),
+				slog.Any("error", err), slog.String("stack", string(debug.Stack())))
+			kv.bgMu.Lock()
+			kv.bgErr = err
+			kv.bgMu.Unlock()
+		}
+	}()
+	fn()
+}
+
+// BackgroundErr returns the last panic recovered in a background task,
+// such as the sync interval flusher or the expiry sweeper, or nil if
+// there hasn't been one.
+func (kv *KV) BackgroundErr() error {
+	kv.bgMu.Lock()
+	defer kv.bgMu.Unlock()
+	return kv.bgErr
+}
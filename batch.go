@@ -0,0 +1,187 @@
+package kv
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Batch collects writes to be applied together with KV.Write.
+// The zero value is an empty batch ready to use.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	op    Op
+	key   string
+	value any
+}
+
+// Set adds a write of the key to the batch.
+func (b *Batch) Set(key string, value any) {
+	b.ops = append(b.ops, batchOp{op: OpSet, key: key, value: value})
+}
+
+// Delete adds a delete of the key to the batch.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{op: OpUnset, key: key})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the batch in order, under a single lock, journaling the
+// operations back to back and flushing the journal once. The values are
+// checked before anything is applied, so a batch with an invalid value
+// leaves the store untouched. An empty batch does nothing.
+func (kv *KV) Write(b *Batch) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	err := kv.checkBatch(b)
+	if err != nil {
+		return err
+	}
+	err = kv.beforeWrite(b.Len())
+	if err != nil {
+		return err
+	}
+	kv.mu.Lock()
+	err = kv.writeLocked(b)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return err
+	}
+	err = kv.settle(seq, slog.String("op", "batch"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteMany removes the keys like a batch of deletes: under a single lock,
+// journaling the deletes back to back and flushing the journal once. Keys
+// that aren't in the store are skipped. It returns the number of keys
+// removed.
+func (kv *KV) DeleteMany(keys []string) (int, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	err := kv.beforeWrite(len(keys))
+	if err != nil {
+		return 0, err
+	}
+	kv.mu.Lock()
+	b := &Batch{}
+	removed := 0
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, ok := kv.memory[key]; !ok {
+			continue
+		}
+		// an expired key is already gone as far as the caller knows.
+		if !kv.expired(key) {
+			removed++
+		}
+		b.Delete(key)
+	}
+	if b.Len() > 0 {
+		err = kv.writeLocked(b)
+	}
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return 0, err
+	}
+	err = kv.settle(seq, slog.String("op", "delete many"), slog.Int("keys", b.Len()))
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// checkBatch checks the values in the batch before it's applied.
+func (kv *KV) checkBatch(b *Batch) error {
+	for _, op := range b.ops {
+		if op.op != OpSet {
+			continue
+		}
+		err := kv.checkValue(op.key, op.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLocked applies the operations in the batch and flushes the journal
+// once. It assumes kv is locked and the batch has passed checkBatch.
+func (kv *KV) writeLocked(b *Batch) error {
+	err := kv.checkRoom(b)
+	if err != nil {
+		return err
+	}
+	for _, op := range b.ops {
+		switch op.op {
+		case OpSet:
+			err = kv.setLocked(op.key, op.value)
+		case OpUnset:
+			if _, ok := kv.memory[op.key]; ok {
+				err = kv.unsetLocked(op.key)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("batch '%s': %w", op.key, err)
+		}
+	}
+	if kv.durability != DurabilitySync && kv.durability != DurabilityNone {
+		_, err := kv.flushLocked()
+		return err
+	}
+	return nil
+}
+
+// checkRoom makes sure a batch won't be rejected halfway through because
+// the store fills up. It assumes kv is locked.
+func (kv *KV) checkRoom(b *Batch) error {
+	if kv.maxKeys <= 0 || kv.eviction != PolicyReject {
+		return nil
+	}
+	present := make(map[string]bool)
+	count := len(kv.memory)
+	for _, op := range b.ops {
+		exists, seen := present[op.key]
+		if !seen {
+			_, exists = kv.memory[op.key]
+		}
+		switch {
+		case op.op == OpSet && !exists:
+			count++
+		case op.op == OpUnset && exists:
+			count--
+		}
+		present[op.key] = op.op == OpSet
+		if count > kv.maxKeys {
+			return fmt.Errorf("%w: %d keys", ErrStoreFull, kv.maxKeys)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	benchValueSizes = []int{16, 1024, 64 * 1024}
+	benchKeyCounts  = []int{1_000, 100_000}
+)
+
+// fill sets n keys, key-0 to key-<n-1>, to value.
+func fill(b *testing.B, kv *KV, n int, value any) {
+	b.Helper()
+	for i := 0; i < n; i++ {
+		err := kv.Set(fmt.Sprintf("key-%d", i), value)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			kv := newTestKV(b)
+			defer kv.Close()
+			value := strings.Repeat("x", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = kv.Set(fmt.Sprintf("key-%d", i), value)
+			}
+		})
+	}
+}
+
+// BenchmarkJournalLog measures encoding and buffering a single record,
+// without the locking and the bookkeeping of Set.
+func BenchmarkJournalLog(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			j, err := newJournal(filepath.Join(b.TempDir(), "bench.wal"), journalConfig{mode: defaultFileMode}, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer j.close()
+			value := strings.Repeat("x", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = j.log(OpSet, "key", value)
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, keys := range benchKeyCounts {
+		b.Run(fmt.Sprintf("keys=%d", keys), func(b *testing.B) {
+			kv := newTestKV(b)
+			defer kv.Close()
+			fill(b, kv, keys, "value")
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = fmt.Sprintf("key-%d", i)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, _ = kv.Get(names[i%keys])
+			}
+		})
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("value=%d", size), func(b *testing.B) {
+			kv := newTestKV(b)
+			defer kv.Close()
+			value := strings.Repeat("x", size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := n.Add(1)
+					_ = kv.Set(fmt.Sprintf("key-%d", i), value)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCoalesce(b *testing.B) {
+	for _, keys := range benchKeyCounts {
+		for _, size := range benchValueSizes[:2] {
+			b.Run(fmt.Sprintf("keys=%d/value=%d", keys, size), func(b *testing.B) {
+				kv := newTestKV(b)
+				defer kv.Close()
+				fill(b, kv, keys, strings.Repeat("x", size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := kv.Coalesce()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSyncedSet measures a single writer under DurabilitySync,
+// paying one fsync per Set.
+func BenchmarkSyncedSet(b *testing.B) {
+	dir := b.TempDir()
+	kv, err := New(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal"), WithDurability(DurabilitySync))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer kv.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+}
+
+// BenchmarkSyncedSetParallel compares concurrent writers that each fsync
+// their own write with writers under DurabilitySync, where group commit
+// lets them share fsyncs. Both run at the same parallelism, and report the
+// fsyncs per write.
+func BenchmarkSyncedSetParallel(b *testing.B) {
+	modes := []struct {
+		name       string
+		durability Durability
+		sync       bool // call Sync after every Set
+	}{
+		{name: "per-write-sync", durability: DurabilityBuffered, sync: true},
+		{name: "group-commit", durability: DurabilitySync},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			dir := b.TempDir()
+			kv, err := New(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal"), WithDurability(mode.durability))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer kv.Close()
+			var n atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := n.Add(1)
+					_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+					if mode.sync {
+						_ = kv.Sync()
+					}
+				}
+			})
+			b.StopTimer()
+			st, _ := kv.Stats()
+			b.ReportMetric(float64(st.Fsyncs)/float64(b.N), "fsyncs/op")
+		})
+	}
+}
+
+// BenchmarkReplay measures opening a store whose keys are all in the
+// journal, with the map left to grow and with it sized up front.
+func BenchmarkReplay(b *testing.B) {
+	const keys = 100_000
+	dir := b.TempDir()
+	dbName, walName := filepath.Join(dir, "bench.db"), filepath.Join(dir, "bench.wal")
+	j, err := newJournal(walName, journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		_, _ = j.log(OpSet, fmt.Sprintf("key-%d", i), i)
+	}
+	_ = j.close()
+	wal, err := os.ReadFile(walName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, capacity := range []int{0, keys} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// opening dumps the replayed journal and empties it, so
+				// start over every time.
+				b.StopTimer()
+				_ = os.Remove(dbName)
+				err := os.WriteFile(walName, wal, defaultFileMode)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				kv, err := New(dbName, walName, WithInitialCapacity(capacity))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = kv.Close()
+			}
+		})
+	}
+}
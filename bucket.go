@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"sort"
+	"strings"
+)
+
+// Bucket is a namespace within the store. Keys in a bucket are stored with
+// the bucket's prefix, so the same key in two buckets refers to two
+// different values. They are journaled and coalesced like any other key.
+type Bucket struct {
+	kv     *KV
+	prefix string
+}
+
+// bucketSep separates the bucket name from the key. It's unlikely to turn
+// up in a key or a bucket name.
+const bucketSep = "\x00"
+
+// Bucket returns a handle to the named bucket. Buckets don't need to be
+// created, a bucket with no keys in it simply doesn't take up any space.
+func (kv *KV) Bucket(name string) *Bucket {
+	return &Bucket{kv: kv, prefix: bucketSep + name + bucketSep}
+}
+
+// Set stores the value under key in the bucket.
+func (b *Bucket) Set(key string, value any) error {
+	return b.kv.Set(b.prefix+key, value)
+}
+
+// Get returns the value stored under key in the bucket.
+func (b *Bucket) Get(key string) (any, bool, error) {
+	return b.kv.Get(b.prefix + key)
+}
+
+// Unset removes key from the bucket.
+func (b *Bucket) Unset(key string) (bool, error) {
+	return b.kv.Unset(b.prefix + key)
+}
+
+// Keys returns the sorted keys in the bucket, without the bucket's prefix.
+func (b *Bucket) Keys() ([]string, error) {
+	if !b.kv.ready.Load() {
+		return nil, ErrClosed
+	}
+	b.kv.mu.Lock()
+	defer b.kv.mu.Unlock()
+	var keys []string
+	for key := range b.kv.memory {
+		if !strings.HasPrefix(key, b.prefix) || b.kv.expired(key) {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(key, b.prefix))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,39 @@
+package kv
+
+import "log/slog"
+
+// removal is a key removed by eviction or expiry, waiting for its callback.
+type removal struct {
+	key     string
+	value   any
+	expired bool
+}
+
+// notifyRemoval queues the callback for a removed key. It assumes kv is
+// locked, the callback runs when unlock is called.
+func (kv *KV) notifyRemoval(key string, value any, expired bool) {
+	if (expired && kv.onExpire == nil) || (!expired && kv.onEvict == nil) {
+		return
+	}
+	kv.removals = append(kv.removals, removal{key: key, value: value, expired: expired})
+}
+
+// unlock releases the lock and then runs the callbacks for keys removed
+// while it was held. Running them outside the lock lets them call back
+// into the store.
+func (kv *KV) unlock() {
+	pending := kv.removals
+	kv.removals = nil
+	kv.mu.Unlock()
+	for _, r := range pending {
+		value, err := unspill(r.value)
+		if err != nil {
+			kv.logger.Error("loading removed value failed", slog.String("key", r.key), slog.Any("error", err))
+		}
+		if r.expired {
+			kv.onExpire(r.key, value)
+		} else {
+			kv.onEvict(r.key, value)
+		}
+	}
+}
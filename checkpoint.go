@@ -0,0 +1,26 @@
+package kv
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Checkpoint writes a marker with the label and the current time to the
+// journal. It changes no data and is skipped when the journal is replayed,
+// but ReadWAL returns it as an OpCheckpoint record, so tools reading the
+// journal can tell what the state was at the checkpoint. Checkpoints go
+// away with the rest of the journal on Coalesce, and nothing is written
+// with DurabilityNone.
+func (kv *KV) Checkpoint(label string) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	kv.mu.Lock()
+	_, err := kv.logTx(OpCheckpoint, Tx{Label: label, Time: kv.now()})
+	seq := kv.seq
+	kv.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("journaling checkpoint: %w", err)
+	}
+	return kv.settle(seq, slog.String("op", "checkpoint"), slog.String("label", label))
+}
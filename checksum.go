@@ -0,0 +1,70 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+)
+
+// ChecksumType is the algorithm used to checksum journal records.
+type ChecksumType uint8
+
+const (
+	// ChecksumCRC32 is CRC-32 with the IEEE polynomial. This is the default.
+	ChecksumCRC32 ChecksumType = iota
+	// ChecksumCRC64 is CRC-64 with the ECMA polynomial. It has a lower
+	// chance of collisions for very large records.
+	ChecksumCRC64
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+func (c ChecksumType) String() string {
+	switch c {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumCRC64:
+		return "crc64"
+	default:
+		return fmt.Sprintf("ChecksumType(%d)", c)
+	}
+}
+
+// size returns the number of bytes the checksum takes up in a record header.
+func (c ChecksumType) size() int {
+	if c == ChecksumCRC64 {
+		return 8
+	}
+	return 4
+}
+
+// sum calculates the checksum of buf, starting from seed rather than 0,
+// see WithChecksumSeed.
+func (c ChecksumType) sum(buf []byte, seed uint32) uint64 {
+	if c == ChecksumCRC64 {
+		return crc64.Update(uint64(seed), crc64Table, buf)
+	}
+	return uint64(crc32.Update(seed, crc32.IEEETable, buf))
+}
+
+// put writes the checksum into buf, which must be at least c.size() long.
+func (c ChecksumType) put(buf []byte, sum uint64) {
+	if c == ChecksumCRC64 {
+		binary.BigEndian.PutUint64(buf, sum)
+		return
+	}
+	binary.BigEndian.PutUint32(buf, uint32(sum))
+}
+
+// get reads the checksum from buf, which must be at least c.size() long.
+func (c ChecksumType) get(buf []byte) uint64 {
+	if c == ChecksumCRC64 {
+		return binary.BigEndian.Uint64(buf)
+	}
+	return uint64(binary.BigEndian.Uint32(buf))
+}
+
+func (c ChecksumType) valid() bool {
+	return c == ChecksumCRC32 || c == ChecksumCRC64
+}
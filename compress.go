@@ -0,0 +1,77 @@
+package kv
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec is the algorithm used to compress journal records.
+type Codec uint8
+
+const (
+	// CodecNone leaves the records uncompressed. This is the default.
+	CodecNone Codec = iota
+	// CodecFlate is DEFLATE at its fastest level.
+	CodecFlate
+)
+
+// opCompressed is set in the op byte of a record header when the payload
+// is compressed with the codec named in the journal header.
+const opCompressed Op = 0x80
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("Codec(%d)", c)
+	}
+}
+
+func (c Codec) valid() bool {
+	return c == CodecNone || c == CodecFlate
+}
+
+// compress compresses buf. It returns buf as is for CodecNone.
+func (c Codec) compress(buf []byte) ([]byte, error) {
+	if c != CodecFlate {
+		return buf, nil
+	}
+	var out bytes.Buffer
+	w, err := flate.NewWriter(&out, flate.BestSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	_, err = w.Write(buf)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compress: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// decompress reverses compress.
+func (c Codec) decompress(buf []byte) ([]byte, error) {
+	if c != CodecFlate {
+		return buf, nil
+	}
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	return out, nil
+}
+
+// splitOp separates the flags, opCompressed and opRawBytes, from the op
+// in a record header.
+func splitOp(op Op) (Op, Op) {
+	return op &^ recordFlags, op & recordFlags
+}
@@ -0,0 +1,31 @@
+package kv
+
+import "fmt"
+
+// CorruptionPolicy decides what happens when a corrupt record is found while
+// replaying the journal.
+type CorruptionPolicy uint8
+
+const (
+	// PolicyAbort fails the replay with ErrJournalCorrupt. This is the default.
+	PolicyAbort CorruptionPolicy = iota
+	// PolicySkipRecord skips the corrupt record and carries on with the next
+	// valid record in the journal.
+	PolicySkipRecord
+	// PolicyTruncate stops at the corrupt record, discarding it and
+	// everything after it.
+	PolicyTruncate
+)
+
+func (p CorruptionPolicy) String() string {
+	switch p {
+	case PolicyAbort:
+		return "abort"
+	case PolicySkipRecord:
+		return "skip record"
+	case PolicyTruncate:
+		return "truncate"
+	default:
+		return fmt.Sprintf("CorruptionPolicy(%d)", p)
+	}
+}
@@ -0,0 +1,250 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrWrongKey = errors.New("wrong encryption key")
+)
+
+// crypter encrypts the dump and the journal with AES-GCM. A nil *crypter
+// means no encryption.
+type crypter struct {
+	aead  cipher.AEAD
+	keyID []byte // identifies the key, stored in the file headers
+}
+
+func newCrypter(key []byte) (*crypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("gcm: %w", err)
+	}
+	// the key id is a truncated hash of the key. It lets us tell a wrong
+	// key from corrupt data, and makes key rotation detectable.
+	sum := sha256.Sum256(append([]byte("gokvstore key id"), key...))
+	return &crypter{aead: aead, keyID: sum[:8]}, nil
+}
+
+// check verifies that data written with keyID can be read with this crypter.
+func (c *crypter) check(keyID []byte) error {
+	switch {
+	case len(keyID) == 0:
+		// not encrypted, readable by anyone.
+		return nil
+	case c == nil:
+		return fmt.Errorf("%w: data is encrypted, but no key is configured", ErrWrongKey)
+	case !bytes.Equal(c.keyID, keyID):
+		return fmt.Errorf("%w: data is encrypted with key id %x, configured key has id %x", ErrWrongKey, keyID, c.keyID)
+	}
+	return nil
+}
+
+// id returns the key id to store in a header, nil if not encrypting.
+func (c *crypter) id() []byte {
+	if c == nil {
+		return nil
+	}
+	return c.keyID
+}
+
+// seal encrypts a single journal record, prefixing it with a random nonce.
+func (c *crypter) seal(plain, aad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+// open decrypts a record produced by seal.
+func (c *crypter) open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("sealed record too short")
+	}
+	nonce, ct := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// The dump is encrypted as a stream of chunks. Each chunk is prefixed with
+// its length, the high bit of which marks the last chunk. The nonce is a
+// random prefix for the stream, the chunk counter and the last-chunk flag,
+// so reordering, dropping or truncating chunks makes decryption fail.
+const (
+	cryptChunkSize   = 64 << 10
+	cryptPrefixSize  = 7
+	cryptLastChunk   = 1 << 31
+	cryptMaxChunkLen = cryptChunkSize + 64
+)
+
+type encWriter struct {
+	w       io.Writer
+	c       *crypter
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newEncWriter returns a writer encrypting everything written to it onto w.
+// It must be closed to write the final chunk.
+func (c *crypter) newEncWriter(w io.Writer) (*encWriter, error) {
+	prefix := make([]byte, cryptPrefixSize)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("nonce prefix: %w", err)
+	}
+	_, err = w.Write(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("write nonce prefix: %w", err)
+	}
+	return &encWriter{w: w, c: c, prefix: prefix}, nil
+}
+
+func (e *encWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	for len(e.buf) > cryptChunkSize {
+		err := e.writeChunk(e.buf[:cryptChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[cryptChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encWriter) Close() error {
+	return e.writeChunk(e.buf, true)
+}
+
+func (e *encWriter) writeChunk(plain []byte, last bool) error {
+	ct := e.c.aead.Seal(nil, chunkNonce(e.prefix, e.counter, last), plain, nil)
+	e.counter++
+	length := uint32(len(ct))
+	if last {
+		length |= cryptLastChunk
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], length)
+	_, err := e.w.Write(lenBuf[:])
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	_, err = e.w.Write(ct)
+	if err != nil {
+		return fmt.Errorf("write chunk: %w", err)
+	}
+	return nil
+}
+
+type decReader struct {
+	r       io.Reader
+	c       *crypter
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// newDecReader returns a reader decrypting a stream written by an encWriter.
+func (c *crypter) newDecReader(r io.Reader) (*decReader, error) {
+	prefix := make([]byte, cryptPrefixSize)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("read nonce prefix: %w", err)
+	}
+	return &decReader{r: r, c: c, prefix: prefix}, nil
+}
+
+func (d *decReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// ReadByte makes decReader an io.ByteReader, so gob doesn't add a
+// buffer on top of it and reading stops exactly where the data ends.
+func (d *decReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(d, b[:])
+	return b[0], err
+}
+
+// finished checks that the whole stream has been read and authenticated.
+func (d *decReader) finished() error {
+	if len(d.buf) > 0 {
+		return errors.New("trailing data in encrypted stream")
+	}
+	for !d.done {
+		err := d.readChunk()
+		if err != nil {
+			return err
+		}
+		if len(d.buf) > 0 {
+			return errors.New("trailing data in encrypted stream")
+		}
+	}
+	return nil
+}
+
+func (d *decReader) readChunk() error {
+	var lenBuf [4]byte
+	_, err := io.ReadFull(d.r, lenBuf[:])
+	if err != nil {
+		return fmt.Errorf("read chunk: %w", io.ErrUnexpectedEOF)
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	last := length&cryptLastChunk != 0
+	length &^= cryptLastChunk
+	if length > cryptMaxChunkLen {
+		return fmt.Errorf("chunk too large: %d bytes", length)
+	}
+	ct := make([]byte, length)
+	_, err = io.ReadFull(d.r, ct)
+	if err != nil {
+		return fmt.Errorf("read chunk: %w", io.ErrUnexpectedEOF)
+	}
+	plain, err := d.c.aead.Open(nil, chunkNonce(d.prefix, d.counter, last), ct, nil)
+	if err != nil {
+		return fmt.Errorf("decrypt chunk %d: %w", d.counter, err)
+	}
+	d.counter++
+	d.buf = plain
+	d.done = last
+	return nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,43 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	ErrDegraded = errors.New("kv is degraded, the journal can't be written")
+)
+
+// walFailed records a failed journal write. With WithFailOnWALError the
+// store is marked as degraded and the error is returned as ErrDegraded.
+// It assumes kv is locked.
+func (kv *KV) walFailed(err error) error {
+	if !kv.failOnWALError {
+		return err
+	}
+	if kv.degraded == nil {
+		kv.logger.Error("journal write failed, store is degraded", slog.Any("error", err))
+		kv.degraded = err
+	}
+	return fmt.Errorf("%w: %v", ErrDegraded, err)
+}
+
+// checkDegraded returns ErrDegraded if an earlier journal write failed.
+// It assumes kv is locked.
+func (kv *KV) checkDegraded() error {
+	if kv.degraded != nil {
+		return fmt.Errorf("%w: %v", ErrDegraded, kv.degraded)
+	}
+	return nil
+}
+
+// Degraded returns the journal error that put the store in the degraded
+// state, or nil if it's healthy. Only stores opened with WithFailOnWALError
+// become degraded. Close and Open the store to recover.
+func (kv *KV) Degraded() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.degraded
+}
@@ -0,0 +1,79 @@
+package kv
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Diff compares two stores. added holds the keys only present in b, removed
+// the keys only present in a and changed the keys present in both but with
+// values that differ according to reflect.DeepEqual. The keys are sorted.
+// The maps are copied under their locks before comparing, so the stores
+// are never locked at the same time.
+func Diff(a, b *KV) (added, removed, changed []string, err error) {
+	am, err := a.copyMemory()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bm, err := b.copyMemory()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for key, av := range am {
+		bv, ok := bm[key]
+		if !ok {
+			removed = append(removed, key)
+			continue
+		}
+		av, err = unspill(av)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bv, err = unspill(bv)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !reflect.DeepEqual(av, bv) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range bm {
+		if _, ok := am[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed, nil
+}
+
+// copyMemory returns a shallow copy of the in-memory map, leaving out the
+// expired keys.
+func (kv *KV) copyMemory() (kvMap, error) {
+	m, _, err := kv.copyMemoryExpiring()
+	return m, err
+}
+
+// copyMemoryExpiring is copyMemory that also copies the deadlines of the
+// keys left in.
+func (kv *KV) copyMemoryExpiring() (kvMap, map[string]time.Time, error) {
+	if !kv.ready.Load() {
+		return nil, nil, ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	m := make(kvMap, len(kv.memory))
+	expires := make(map[string]time.Time, len(kv.expires))
+	for key, value := range kv.memory {
+		if kv.expired(key) {
+			continue
+		}
+		m[key] = value
+		if deadline, ok := kv.expires[key]; ok {
+			expires[key] = deadline
+		}
+	}
+	return m, expires, nil
+}
@@ -0,0 +1,24 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// renameFile renames from to to. With dirSync, the directory is fsynced
+// afterwards, as on some filesystems the rename isn't durable until then.
+func renameFile(from, to string, dirSync bool) error {
+	err := os.Rename(from, to)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if !dirSync {
+		return nil
+	}
+	err = syncDir(filepath.Dir(to))
+	if err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package kv
+
+// syncDir does nothing, directories can't be fsynced on this platform.
+func syncDir(name string) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package kv
+
+import "os"
+
+// dirHandle is the part of *os.File syncDir needs.
+type dirHandle interface {
+	Sync() error
+	Close() error
+}
+
+// openDir opens a directory for syncDir. Tests replace it to spy on the syncs.
+var openDir = func(name string) (dirHandle, error) {
+	return os.Open(name)
+}
+
+// syncDir fsyncs the directory, making the renames in it durable.
+func syncDir(name string) error {
+	dir, err := openDir(name)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package kv
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// spyDir counts the calls to Sync on a directory.
+type spyDir struct {
+	dirHandle
+	syncs *atomic.Int32
+}
+
+func (d spyDir) Sync() error {
+	d.syncs.Add(1)
+	return d.dirHandle.Sync()
+}
+
+func spyOnDirs(t *testing.T) *atomic.Int32 {
+	var syncs atomic.Int32
+	orig := openDir
+	openDir = func(name string) (dirHandle, error) {
+		dir, err := orig(name)
+		if err != nil {
+			return nil, err
+		}
+		return spyDir{dirHandle: dir, syncs: &syncs}, nil
+	}
+	t.Cleanup(func() { openDir = orig })
+	return &syncs
+}
+
+func TestDirSync(t *testing.T) {
+	syncs := spyOnDirs(t)
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	err := kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs.Load(); n != 1 {
+		t.Errorf("directory synced %d times after Coalesce, want 1", n)
+	}
+}
+
+func TestDirSyncDisabled(t *testing.T) {
+	syncs := spyOnDirs(t)
+	kv := newTestKV(t, WithDirSync(false))
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	err := kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := syncs.Load(); n != 0 {
+		t.Errorf("directory synced %d times with WithDirSync(false)", n)
+	}
+}
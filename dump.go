@@ -0,0 +1,217 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The dump starts with dumpMagic and a version byte. Version 1 is the
+// original format, a single gob-encoded map with no magic at all.
+// Version 2 is a gob-encoded dumpHeader followed by a separate gob stream
+// with one dumpEntry per key, so it can be loaded without decoding the
+// whole map at once. If the header has a key id, the entry stream is
+// encrypted. Version 3 added the expiry deadlines to the entries.
+const (
+	dumpMagic   = "GKVD"
+	dumpVersion = 3
+)
+
+var (
+	ErrDumpVersion = errors.New("unsupported dump version")
+)
+
+// dumpHeader follows the magic and the version. Fields can be added to it
+// without breaking older dumps, gob leaves missing fields at their zero value.
+type dumpHeader struct {
+	Count   int    // number of entries that follow
+	KeyID   []byte // id of the encryption key, empty if not encrypted
+	StoreID []byte // id shared with the store's journal, empty in dumps from before it
+	// Types holds the types of the values, so unregistered types can be
+	// reported up front. Left out of encrypted dumps, as the header is
+	// stored in the clear.
+	Types []typeProbe
+}
+
+// dumpConfig holds the settings used when reading and writing the dump file.
+type dumpConfig struct {
+	crypt    *crypter    // encrypts the dump, nil if not encrypting
+	mode     os.FileMode // permissions for a newly created dump
+	storeID  []byte      // written to the header, see newStoreID
+	dirSync  bool        // fsync the directory after renaming the dump into place
+	capacity int         // the map is allocated for at least this many keys
+}
+
+type dumpEntry struct {
+	Key     string
+	Value   any
+	Expires time.Time // when the key expires, zero if it doesn't
+}
+
+// writeDump writes the map to w in the current dump format, encrypting
+// it if c is not nil. The deadlines of the keys that expire are taken from
+// expires, which may be nil. storeID goes in the header, it may be nil.
+func writeDump(w io.Writer, m kvMap, expires map[string]time.Time, c *crypter, storeID []byte) error {
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(dumpMagic)
+	if err != nil {
+		return fmt.Errorf("write magic: %w", err)
+	}
+	err = bw.WriteByte(dumpVersion)
+	if err != nil {
+		return fmt.Errorf("write version: %w", err)
+	}
+	header := dumpHeader{Count: len(m), KeyID: c.id(), StoreID: storeID}
+	if c == nil {
+		header.Types, err = probeTypes(m)
+		if err != nil {
+			return fmt.Errorf("probe types: %w", err)
+		}
+	}
+	err = gob.NewEncoder(bw).Encode(header)
+	if err != nil {
+		return fmt.Errorf("encode header: %w", err)
+	}
+	var payload io.Writer = bw
+	var ew *encWriter
+	if c != nil {
+		ew, err = c.newEncWriter(bw)
+		if err != nil {
+			return err
+		}
+		payload = ew
+	}
+	enc := gob.NewEncoder(payload)
+	for key, value := range m {
+		value, err = unspill(value)
+		if err != nil {
+			return fmt.Errorf("load '%s': %w", key, err)
+		}
+		err = enc.Encode(dumpEntry{Key: key, Value: value, Expires: expires[key]})
+		if err != nil {
+			return fmt.Errorf("encode '%s': %w", key, err)
+		}
+	}
+	if ew != nil {
+		err = ew.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+// readDump reads a dump in any of the supported formats. c is needed to
+// read an encrypted dump, unencrypted dumps are read regardless.
+func readDump(r io.Reader, c *crypter) (kvMap, error) {
+	var memory kvMap
+	err := readDumpFunc(r, c, func(n int, _ []byte) {
+		memory = make(kvMap, n)
+	}, func(key string, value any, _ time.Time) error {
+		memory[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return memory, nil
+}
+
+// readDumpFunc reads a dump like readDump, calling begin with the number of
+// entries and the store id before calling add for each of them, with the
+// key's expiry deadline, zero if it doesn't expire.
+func readDumpFunc(r io.Reader, c *crypter, begin func(n int, storeID []byte), add func(key string, value any, expires time.Time) error) error {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(len(dumpMagic) + 1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read magic: %w", err)
+	}
+	if !bytes.HasPrefix(prefix, []byte(dumpMagic)) {
+		// no magic, this is a version 1 dump.
+		var memory kvMap
+		err = gob.NewDecoder(br).Decode(&memory)
+		if err != nil {
+			return fmt.Errorf("decoding map: %w", err)
+		}
+		begin(len(memory), nil)
+		for key, value := range memory {
+			err = add(key, value, time.Time{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, _ = br.Discard(len(prefix))
+	version := prefix[len(dumpMagic)]
+	// version 2 is read like 3, the deadlines are left at zero.
+	if version < 2 || version > dumpVersion {
+		return fmt.Errorf("%w: %d", ErrDumpVersion, version)
+	}
+	var header dumpHeader
+	err = gob.NewDecoder(br).Decode(&header)
+	if err != nil {
+		return fmt.Errorf("decoding header: %w", err)
+	}
+	err = checkTypes(header.Types)
+	if err != nil {
+		return err
+	}
+	var payload io.Reader = br
+	var dr *decReader
+	if len(header.KeyID) > 0 {
+		err = c.check(header.KeyID)
+		if err != nil {
+			return err
+		}
+		dr, err = c.newDecReader(br)
+		if err != nil {
+			return err
+		}
+		payload = dr
+	}
+	dec := gob.NewDecoder(payload)
+	begin(header.Count, header.StoreID)
+	for i := 0; i < header.Count; i++ {
+		var entry dumpEntry
+		err = dec.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("decoding entry %d: %w", i, err)
+		}
+		err = add(entry.Key, entry.Value, entry.Expires)
+		if err != nil {
+			return err
+		}
+	}
+	if dr != nil {
+		// the header isn't encrypted, make sure the count wasn't tampered with:
+		err = dr.finished()
+		if err != nil {
+			return fmt.Errorf("decrypting dump: %w", err)
+		}
+	}
+	return nil
+}
+
+// newStoreID returns a random id for a new store. It's written to the dump
+// and the journal, so a journal can't be replayed on another store's dump.
+func newStoreID() []byte {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return id
+}
+
+// createFile creates or truncates the named file, using mode for new files.
+func createFile(name string, mode os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+}
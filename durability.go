@@ -0,0 +1,188 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// Durability decides how hard the store works to get writes onto stable storage.
+type Durability uint8
+
+const (
+	// DurabilityBuffered writes every change to the journal buffer, which is
+	// written to the OS when it fills up or on Flush. Nothing is fsynced.
+	// This is the default.
+	DurabilityBuffered Durability = iota
+	// DurabilityNone keeps the data in memory only. Nothing is journaled, so
+	// changes since the last Coalesce are lost when the store is closed.
+	DurabilityNone
+	// DurabilityFlush flushes and fsyncs the journal on the sync interval.
+	DurabilityFlush
+	// DurabilitySync flushes and fsyncs the journal after every write.
+	DurabilitySync
+)
+
+// defaultSyncInterval is used by DurabilityFlush when no interval is set.
+const defaultSyncInterval = time.Second
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityBuffered:
+		return "buffered"
+	case DurabilityFlush:
+		return "flush"
+	case DurabilitySync:
+		return "sync"
+	default:
+		return fmt.Sprintf("Durability(%d)", d)
+	}
+}
+
+// resolveDurability maps the sync options onto a durability level.
+// An explicit WithDurability always wins. Otherwise WithSyncEvery gives
+// DurabilitySync and WithSyncInterval gives DurabilityFlush.
+func (kv *KV) resolveDurability() {
+	if !kv.durabilitySet {
+		switch {
+		case kv.syncEvery:
+			kv.durability = DurabilitySync
+		case kv.syncInterval > 0:
+			kv.durability = DurabilityFlush
+		default:
+			kv.durability = DurabilityBuffered
+		}
+	}
+	if kv.durability == DurabilityFlush && kv.syncInterval <= 0 {
+		kv.syncInterval = defaultSyncInterval
+	}
+}
+
+// syncDelay returns the time until the next sync, the sync interval moved
+// by a random amount of up to ±syncJitter of it.
+func (kv *KV) syncDelay(rng *rand.Rand) time.Duration {
+	if kv.syncJitter <= 0 {
+		return kv.syncInterval
+	}
+	jitter := kv.syncJitter * (2*rng.Float64() - 1)
+	return kv.syncInterval + time.Duration(jitter*float64(kv.syncInterval))
+}
+
+// logOp journals the operation unless the store is memory only.
+// It returns the number of bytes written to the journal.
+// It assumes kv is locked.
+func (kv *KV) logOp(op Op, key string, value any) (int, error) {
+	return kv.logTx(op, Tx{Key: key, Value: value})
+}
+
+// logTx journals the transaction unless the store is memory only.
+// It assumes kv is locked.
+func (kv *KV) logTx(op Op, tx Tx) (int, error) {
+	// keys still expire in a snapshot, there's just nothing to journal.
+	if kv.readOnly && op != OpExpire {
+		return 0, ErrReadOnly
+	}
+	kv.dirty = true
+	kv.countOp()
+	if kv.durability == DurabilityNone {
+		return 0, nil
+	}
+	err := kv.checkDegraded()
+	if err != nil {
+		return 0, err
+	}
+	n, err := kv.journal.logTx(op, tx)
+	if err != nil {
+		return n, kv.walFailed(err)
+	}
+	kv.seq++
+	kv.publish(op, tx)
+	kv.checkRatio()
+	return n, nil
+}
+
+// afterWrite flushes and fsyncs the journal if the durability level requires it.
+// seq is the sequence number of the record just written, under DurabilitySync
+// the call blocks until that record is on stable storage.
+func (kv *KV) afterWrite(seq uint64) error {
+	if kv.syncWindow > 0 && kv.durability != DurabilitySync && kv.durability != DurabilityNone {
+		kv.openSyncWindow()
+	}
+	switch kv.durability {
+	case DurabilitySync:
+		return kv.commit(seq)
+	case DurabilityFlush:
+		kv.mu.Lock()
+		due := time.Since(kv.lastFlush) > kv.syncInterval
+		kv.mu.Unlock()
+		if due {
+			return kv.Sync()
+		}
+	}
+	return nil
+}
+
+// openSyncWindow starts the timer that fsyncs the journal at the end of
+// the sync window, unless one is running already, so the writes made
+// within the window share the fsync.
+func (kv *KV) openSyncWindow() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.windowTimer != nil || !kv.ready.Load() {
+		return
+	}
+	kv.windowTimer = time.AfterFunc(kv.syncWindow, func() {
+		kv.mu.Lock()
+		kv.windowTimer = nil
+		kv.mu.Unlock()
+		// a write from here on opens the next window.
+		err := kv.Sync()
+		if err != nil && !errors.Is(err, ErrClosed) {
+			kv.logger.Error("sync window fsync failed", slog.String("op", "sync"), slog.Any("error", err))
+		}
+	})
+}
+
+// syncSeq flushes and fsyncs the journal, returning the sequence number of
+// the last record covered by the sync.
+func (kv *KV) syncSeq() (uint64, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	_, err := kv.flushLocked()
+	if err != nil || kv.readOnly {
+		return 0, err
+	}
+	start := time.Now()
+	err = kv.journal.sync()
+	kv.fsyncs++
+	kv.fsyncTime += time.Since(start)
+	if kv.latency != nil {
+		kv.latency.observe(latencyFsync, start)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sync: %w", kv.walFailed(err))
+	}
+	return kv.seq, nil
+}
+
+// settle runs afterWrite for the record just written. A failure is logged
+// with the attributes, and only returned under write-through, where a
+// successful write must be on stable storage.
+func (kv *KV) settle(seq uint64, attrs ...any) error {
+	err := kv.afterWrite(seq)
+	if err == nil {
+		return nil
+	}
+	kv.logger.Error("flushing journal failed", append(attrs, slog.Any("error", err))...)
+	if kv.writeThrough {
+		return err
+	}
+	return nil
+}
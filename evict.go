@@ -0,0 +1,104 @@
+package kv
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+)
+
+// EvictionPolicy decides what happens when a new key is written to a full store.
+type EvictionPolicy uint8
+
+const (
+	// PolicyReject makes the write fail with ErrStoreFull.
+	PolicyReject EvictionPolicy = iota
+	// PolicyEvictLRU removes the least recently used key to make room.
+	PolicyEvictLRU
+)
+
+var (
+	ErrStoreFull = errors.New("store is full")
+)
+
+// lru keeps the keys ordered by when they were last used, most recent first.
+type lru struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRU(m kvMap) *lru {
+	l := &lru{order: list.New(), elems: make(map[string]*list.Element, len(m))}
+	for key := range m {
+		l.touch(key)
+	}
+	return l
+}
+
+func (l *lru) touch(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elems[key] = l.order.PushFront(key)
+}
+
+func (l *lru) forget(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+// oldest returns the least recently used key.
+func (l *lru) oldest() (string, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// admit makes room for key according to the eviction policy.
+// It assumes kv is locked.
+func (kv *KV) admit(key string) error {
+	if kv.maxKeys <= 0 {
+		return nil
+	}
+	if _, ok := kv.memory[key]; ok {
+		return nil
+	}
+	for len(kv.memory) >= kv.maxKeys {
+		if kv.eviction == PolicyReject {
+			return fmt.Errorf("%w: %d keys", ErrStoreFull, kv.maxKeys)
+		}
+		victim, ok := kv.recency.oldest()
+		if !ok {
+			return fmt.Errorf("%w: nothing to evict", ErrStoreFull)
+		}
+		value := kv.memory[victim]
+		err := kv.unsetLocked(victim)
+		if err != nil {
+			return fmt.Errorf("evicting '%s': %w", victim, err)
+		}
+		kv.notifyRemoval(victim, value, false)
+	}
+	return nil
+}
+
+// touch marks the key as used. It assumes kv is locked.
+func (kv *KV) touch(key string) {
+	if kv.recency != nil {
+		kv.recency.touch(key)
+	}
+}
+
+// forget drops the key from the recency tracking and the read cache.
+// It assumes kv is locked.
+func (kv *KV) forget(key string) {
+	if kv.recency != nil {
+		kv.recency.forget(key)
+	}
+	if kv.readCache != nil {
+		kv.readCache.forget(key)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package kv
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	kv := newTestKV(t, WithFileMode(0o600))
+	err := kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{kv.fileName, kv.walName} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %v, want 0600", name, fi.Mode().Perm())
+		}
+	}
+}
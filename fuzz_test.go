@@ -0,0 +1,69 @@
+package kv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// validJournal returns the bytes of a journal with a few records in it,
+// one of them raw bytes.
+func validJournal(f *testing.F, cfg journalConfig) []byte {
+	f.Helper()
+	wal := filepath.Join(f.TempDir(), "seed.wal")
+	j, err := newJournal(wal, cfg, 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, _ = j.log(OpSet, "foo", 1)
+	_, _ = j.log(OpSet, "bar", "baz")
+	_, _ = j.log(OpUnset, "foo", nil)
+	_, _ = j.log(OpSet, "blob", []byte("raw bytes"))
+	err = j.close()
+	if err != nil {
+		f.Fatal(err)
+	}
+	buf, err := os.ReadFile(wal)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return buf
+}
+
+func FuzzPlay(f *testing.F) {
+	for _, cfg := range []journalConfig{{mode: defaultFileMode}, {checksum: ChecksumCRC64, mode: defaultFileMode}} {
+		valid := validJournal(f, cfg)
+		f.Add(valid)
+		// near misses: truncated, a flipped bit and a huge record length.
+		f.Add(valid[:len(valid)-1])
+		f.Add(valid[:len(valid)/2])
+		flipped := bytes.Clone(valid)
+		flipped[len(flipped)-3] ^= 0x10
+		f.Add(flipped)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{byte(OpSet), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	f.Add([]byte(journalMagic))
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		wal := filepath.Join(dir, "fuzz.wal")
+		err := os.WriteFile(wal, data, 0o666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(kvMap)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = play(wal, &m, journalConfig{})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("play hung")
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package kv
+
+import "sync"
+
+// groupCommit lets concurrent writers share a single flush and fsync.
+// Every journaled record gets a sequence number. A writer waiting for its
+// record to become durable either finds that someone else already synced
+// past it, waits for the sync in progress, or becomes the leader and syncs
+// everything written so far on behalf of all the waiters.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	synced  uint64 // highest sequence number known to be on stable storage
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// commit blocks until the journal record with sequence number seq has been
+// flushed and fsynced.
+func (kv *KV) commit(seq uint64) error {
+	g := kv.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		// we're the leader, sync on behalf of everyone:
+		g.syncing = true
+		g.mu.Unlock()
+		synced, err := kv.syncSeq()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if synced > g.synced {
+			g.synced = synced
+		}
+	}
+	return nil
+}
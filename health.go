@@ -0,0 +1,31 @@
+package kv
+
+import "time"
+
+// HealthStatus describes the state of the store, for readiness and
+// liveness probes.
+type HealthStatus struct {
+	Ready         bool      // open and able to take writes
+	Closed        bool      // not open, see Open
+	Degraded      error     // the journal error that degraded the store, see Degraded
+	LastFlush     time.Time // when the journal was last flushed successfully
+	CoalesceErr   error     // error of the last coalesce, nil if it succeeded
+	BackgroundErr error     // last panic recovered in a background task, see BackgroundErr
+}
+
+// Health returns the current state of the store. A store is only Ready if
+// it's open and not degraded. It can be called at any time, also on a
+// closed store.
+func (kv *KV) Health() HealthStatus {
+	kv.mu.Lock()
+	status := HealthStatus{
+		Closed:      !kv.ready.Load(),
+		Degraded:    kv.degraded,
+		LastFlush:   kv.lastFlush,
+		CoalesceErr: kv.coalesceErr,
+	}
+	kv.mu.Unlock()
+	status.BackgroundErr = kv.BackgroundErr()
+	status.Ready = !status.Closed && status.Degraded == nil
+	return status
+}
@@ -0,0 +1,82 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// coalesceInBackground starts a coalesce in the background, unless one is
+// already running. Writers waiting in waitForWAL are woken when it's done,
+// whether it succeeded or not.
+func (kv *KV) coalesceInBackground() {
+	if !kv.autoCoalescing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer func() {
+			kv.autoCoalescing.Store(false)
+			kv.mu.Lock()
+			kv.walDrained.Broadcast()
+			kv.mu.Unlock()
+		}()
+		kv.guard("auto coalesce", func() {
+			err := kv.coalesce()
+			if err != nil && !errors.Is(err, ErrNotReady) {
+				kv.logger.Error("auto coalesce failed", slog.String("op", "coalesce"), slog.Any("error", err))
+			}
+		})
+	}()
+}
+
+// minWALHighWater is the smallest high-water mark WithWALHighWater takes.
+// The journal never gets smaller than its header, so the low-water mark,
+// half the high one, must leave room for it.
+const minWALHighWater = 4096
+
+// waitForWAL blocks while the journal is over the high-water mark, until a
+// coalesce brings it down to the low-water mark, half the high one. Reaching
+// the high-water mark starts a coalesce in the background, and another one
+// is started if that wasn't enough. If a coalesce fails, the writer gets
+// the error instead of waiting for one that might never succeed, and if it
+// finishes without emptying the journal, there's nothing more to wait for.
+func (kv *KV) waitForWAL() error {
+	if kv.walHighWater <= 0 {
+		return nil
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	size := kv.journal.size()
+	if size < kv.walHighWater {
+		return nil
+	}
+	for size > kv.walHighWater/2 {
+		coalesces := kv.coalesces
+		kv.coalesceInBackground()
+		kv.walDrained.Wait()
+		if !kv.ready.Load() {
+			return ErrClosed
+		}
+		if kv.coalesceErr != nil {
+			return fmt.Errorf("waiting for the journal to drain: %w", kv.coalesceErr)
+		}
+		if kv.coalesces == coalesces && !kv.autoCoalescing.Load() {
+			return nil
+		}
+		size = kv.journal.size()
+	}
+	return nil
+}
+
+// beforeWrite applies the rate limit and the WAL high-water mark to a write
+// of n operations. It must be called without holding the lock.
+func (kv *KV) beforeWrite(n int) error {
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	err := kv.throttle(n)
+	if err != nil {
+		return err
+	}
+	return kv.waitForWAL()
+}
@@ -0,0 +1,55 @@
+package kv
+
+import "time"
+
+// coalesceHistoryLen is the number of coalesces CoalesceHistory remembers.
+const coalesceHistoryLen = 32
+
+// CoalesceEvent describes a finished coalesce.
+type CoalesceEvent struct {
+	Time         time.Time     // when it finished
+	Duration     time.Duration // how long it took
+	DumpBytes    int64         // size of the dump written
+	WALReclaimed int64         // bytes the journal shrank by
+}
+
+// coalesceHistory is a ring buffer of the last coalesces.
+type coalesceHistory struct {
+	events [coalesceHistoryLen]CoalesceEvent
+	next   int // where the next event goes
+	n      int // number of events held
+}
+
+func (h *coalesceHistory) add(e CoalesceEvent) {
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+	h.n = min(h.n+1, len(h.events))
+}
+
+// list returns the events, oldest first.
+func (h *coalesceHistory) list() []CoalesceEvent {
+	events := make([]CoalesceEvent, 0, h.n)
+	start := (h.next - h.n + len(h.events)) % len(h.events)
+	for i := 0; i < h.n; i++ {
+		events = append(events, h.events[(start+i)%len(h.events)])
+	}
+	return events
+}
+
+// recordCoalesce adds a coalesce that started at start, with the journal
+// at walBefore bytes, to the history. It assumes kv is locked.
+func (kv *KV) recordCoalesce(start time.Time, walBefore int64) {
+	kv.statDump()
+	e := CoalesceEvent{Time: kv.now(), Duration: time.Since(start), DumpBytes: kv.dumpSize}
+	e.WALReclaimed = max(walBefore-kv.journal.size(), 0)
+	kv.history.add(e)
+}
+
+// CoalesceHistory returns the last coalesces, oldest first. Coalesces that
+// had nothing to do aren't included. The history is kept in memory only,
+// and holds up to 32 events.
+func (kv *KV) CoalesceHistory() []CoalesceEvent {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.history.list()
+}
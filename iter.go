@@ -0,0 +1,31 @@
+package kv
+
+import "iter"
+
+// Iter returns an iterator over the keys and values in the store, in no
+// particular order. It works like a ReadTx: the entries are the ones in the
+// store when the iteration starts, without copying the map up front, and the
+// store can be written to during the iteration without affecting it.
+// Expired keys are left out. Iterating over a closed store yields nothing,
+// and the iteration stops early if a spilled value can't be read back.
+func (kv *KV) Iter() iter.Seq2[string, any] {
+	return func(yield func(string, any) bool) {
+		tx, err := kv.ReadTx()
+		if err != nil {
+			return
+		}
+		defer tx.Close()
+		for key, value := range tx.memory {
+			if tx.expired(key) {
+				continue
+			}
+			value, err := unspill(value)
+			if err != nil {
+				return
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package kv
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+func init() {
+	// json objects and arrays decode into these, and gob needs to know them
+	// to journal them as values.
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+}
+
+// ImportMode decides what happens to existing keys when importing.
+type ImportMode uint8
+
+const (
+	// ImportMerge keeps existing keys, overwriting those present in the import.
+	ImportMerge ImportMode = iota
+	// ImportReplace removes all existing keys before importing.
+	ImportReplace
+)
+
+// ExportJSON writes the whole store as a single JSON object to path.
+// Values are encoded with encoding/json, so this is lossy compared to gob:
+// integers come back as float64, structs come back as map[string]any and
+// values json can't encode (channels, funcs, ...) makes the export fail.
+func (kv *KV) ExportJSON(path string) error {
+	buf, err := kv.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, buf, 0o666)
+	if err != nil {
+		return fmt.Errorf("write '%s': %w", path, err)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the store as a JSON object, see ExportJSON for how
+// the values are encoded. The entries are taken like a ReadTx, so the store
+// isn't locked while they are encoded, and expired keys are left out.
+func (kv *KV) MarshalJSON() ([]byte, error) {
+	tx, err := kv.ReadTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	live := make(map[string]any, len(tx.memory))
+	for key, value := range tx.memory {
+		if !tx.expired(key) {
+			live[key] = value
+		}
+	}
+	buf, err := json.Marshal(live)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	return buf, nil
+}
+
+// ImportJSON loads a JSON object from path into the store. Every change is
+// journaled, so the import is durable once the journal is flushed. Like a
+// batch, it is held up by the write rate limit and the WAL high-water mark.
+// See ExportJSON for how types are mapped.
+func (kv *KV) ImportJSON(path string, mode ImportMode) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read '%s': %w", path, err)
+	}
+	var data map[string]any
+	err = json.Unmarshal(buf, &data)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	// every key imported is a write, and replacing may delete every key
+	// already in the store.
+	n := len(data)
+	if mode == ImportReplace {
+		count, err := kv.CountPrefix("")
+		if err != nil {
+			return err
+		}
+		n += count
+	}
+	if n == 0 {
+		return nil
+	}
+	err = kv.beforeWrite(n)
+	if err != nil {
+		return err
+	}
+	kv.mu.Lock()
+	err = kv.importLocked(data, mode)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return err
+	}
+	return kv.settle(seq, slog.String("op", "import json"), slog.Int("keys", len(data)))
+}
+
+// importLocked does the work of ImportJSON. It assumes kv is locked.
+func (kv *KV) importLocked(data map[string]any, mode ImportMode) error {
+	if mode == ImportReplace {
+		for key := range kv.memory {
+			if _, ok := data[key]; ok {
+				continue
+			}
+			err := kv.unsetLocked(key)
+			if err != nil {
+				return fmt.Errorf("unset '%s': %w", key, err)
+			}
+		}
+	}
+	for key, value := range data {
+		err := kv.setLocked(key, value)
+		if err != nil {
+			return fmt.Errorf("set '%s': %w", key, err)
+		}
+	}
+	return nil
+}
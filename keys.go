@@ -0,0 +1,114 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// KeyCodec turns keys of type K into the string keys of the store and
+// back. Encoding must be one to one, or different keys end up sharing a
+// value.
+type KeyCodec[K any] interface {
+	EncodeKey(key K) (string, error)
+	DecodeKey(s string) (K, error)
+}
+
+// IntKeys encodes int keys in decimal.
+type IntKeys struct{}
+
+func (IntKeys) EncodeKey(key int) (string, error) { return strconv.Itoa(key), nil }
+
+func (IntKeys) DecodeKey(s string) (int, error) { return strconv.Atoi(s) }
+
+// JSONKeys encodes keys as JSON, which works for structs of basic types.
+// encoding/json writes struct fields in a fixed order, so equal keys always
+// encode the same.
+type JSONKeys[K any] struct{}
+
+func (JSONKeys[K]) EncodeKey(key K) (string, error) {
+	b, err := json.Marshal(key)
+	return string(b), err
+}
+
+func (JSONKeys[K]) DecodeKey(s string) (K, error) {
+	var key K
+	err := json.Unmarshal([]byte(s), &key)
+	return key, err
+}
+
+// TypedKV is a view of the store with keys of type K and values of type V.
+// The keys are encoded with the codec, and the values are stored as they
+// are, so V must be registered with gob like any other value type. The
+// store can be shared with other views, but Keys only makes sense if every
+// key in it was written through a view with the same codec.
+type TypedKV[K comparable, V any] struct {
+	kv    *KV
+	codec KeyCodec[K]
+}
+
+// NewTypedKV returns a view of kv with keys of type K, encoded with codec,
+// and values of type V.
+func NewTypedKV[K comparable, V any](kv *KV, codec KeyCodec[K]) *TypedKV[K, V] {
+	return &TypedKV[K, V]{kv: kv, codec: codec}
+}
+
+// encode encodes the key with the codec.
+func (t *TypedKV[K, V]) encode(key K) (string, error) {
+	s, err := t.codec.EncodeKey(key)
+	if err != nil {
+		return "", fmt.Errorf("encoding key %v: %w", key, err)
+	}
+	return s, nil
+}
+
+// Set stores the value under key.
+func (t *TypedKV[K, V]) Set(key K, value V) error {
+	s, err := t.encode(key)
+	if err != nil {
+		return err
+	}
+	return t.kv.Set(s, value)
+}
+
+// Get returns the value stored under key. It fails with ErrWrongType if the
+// value isn't a V.
+func (t *TypedKV[K, V]) Get(key K) (V, bool, error) {
+	s, err := t.encode(key)
+	if err != nil {
+		var zero V
+		return zero, false, err
+	}
+	return getAs[V](t.kv, s)
+}
+
+// Unset removes key.
+func (t *TypedKV[K, V]) Unset(key K) (bool, error) {
+	s, err := t.encode(key)
+	if err != nil {
+		return false, err
+	}
+	return t.kv.Unset(s)
+}
+
+// Keys returns the keys in the store, in no particular order. It fails if
+// a key can't be decoded.
+func (t *TypedKV[K, V]) Keys() ([]K, error) {
+	if !t.kv.ready.Load() {
+		return nil, ErrClosed
+	}
+	t.kv.mu.Lock()
+	defer t.kv.mu.Unlock()
+	keys := make([]K, 0, len(t.kv.memory))
+	for s := range t.kv.memory {
+		if t.kv.expired(s) {
+			continue
+		}
+		key, err := t.codec.DecodeKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key '%s': %w", s, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the histogram buckets. The last
+// bucket takes everything slower than the last bound.
+var latencyBounds = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// The operations tracked with WithLatencyTracking.
+const (
+	latencySet = iota
+	latencyGet
+	latencyCoalesce
+	latencyFlush
+	latencyFsync
+	latencyOps
+)
+
+var latencyNames = [latencyOps]string{"set", "get", "coalesce", "flush", "fsync"}
+
+// Histogram counts the calls to an operation by how long they took.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets, Counts[i] is the number of
+	// calls that took at most Bounds[i]. Counts has an extra bucket at the
+	// end for the calls slower than the last bound.
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64        // total number of calls
+	Total  time.Duration // total time spent
+}
+
+// latencyHistogram is the lock free version of Histogram.
+type latencyHistogram struct {
+	counts [len(latencyBounds) + 1]atomic.Uint64
+	count  atomic.Uint64
+	total  atomic.Int64
+}
+
+// latencyTracker holds a histogram per tracked operation.
+type latencyTracker struct {
+	ops [latencyOps]latencyHistogram
+}
+
+// observe records a call to op that started at start.
+func (l *latencyTracker) observe(op int, start time.Time) {
+	d := time.Since(start)
+	h := &l.ops[op]
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.total.Add(int64(d))
+}
+
+// Latencies returns a histogram of the latencies of Set, Get, Coalesce,
+// Flush and the fsyncs of the journal, keyed by "set", "get", "coalesce",
+// "flush" and "fsync". It returns nil unless the store was opened with
+// WithLatencyTracking. Coalesce covers Compact, and Flush covers every
+// flush of the journal buffer, including the ones done by Sync. The fsync
+// that follows the flush in Sync is only counted under "fsync".
+func (kv *KV) Latencies() map[string]Histogram {
+	if kv.latency == nil {
+		return nil
+	}
+	m := make(map[string]Histogram, latencyOps)
+	for op, name := range latencyNames {
+		h := &kv.latency.ops[op]
+		counts := make([]uint64, len(h.counts))
+		for i := range h.counts {
+			counts[i] = h.counts[i].Load()
+		}
+		m[name] = Histogram{
+			Bounds: append([]time.Duration(nil), latencyBounds[:]...),
+			Counts: counts,
+			Count:  h.count.Load(),
+			Total:  time.Duration(h.total.Load()),
+		}
+	}
+	return m
+}
@@ -0,0 +1,79 @@
+package kv
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// countingWriter counts the bytes written to it and throws them away.
+type countingWriter struct {
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
+
+// encodedSize returns the size of the value when gob-encoded the way the
+// journal encodes it, type information included.
+func encodedSize(value any) (int, error) {
+	var cw countingWriter
+	err := gob.NewEncoder(&cw).Encode(Tx{Value: value})
+	if err != nil {
+		return 0, fmt.Errorf("encode value: %w", err)
+	}
+	return cw.n, nil
+}
+
+// checkValue returns an error if the value is larger than allowed.
+func (kv *KV) checkValue(key string, value any) error {
+	if kv.maxValueSize <= 0 {
+		return nil
+	}
+	size, err := encodedSize(value)
+	if err != nil {
+		return err
+	}
+	if size > kv.maxValueSize {
+		return fmt.Errorf("%w: '%s' is %d bytes encoded, the limit is %d", ErrValueTooLarge, key, size, kv.maxValueSize)
+	}
+	return nil
+}
+
+// Validate runs the checks Set makes before writing, without writing: the
+// value must gob-encode, fit in WithMaxValueSize, and fit in the store if
+// it's full and the WithMaxKeys policy is PolicyReject. A degraded store
+// fails with ErrDegraded. Nothing is changed, so a batch can be validated
+// before any of it is written. A nil error doesn't promise the Set will
+// succeed, the store can change in between.
+func (kv *KV) Validate(key string, value any) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	// checkValue only encodes the value if there's a limit.
+	err := kv.checkValue(key, value)
+	if err == nil && kv.maxValueSize <= 0 {
+		_, err = encodedSize(value)
+	}
+	if err != nil {
+		return err
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	err = kv.checkDegraded()
+	if err != nil {
+		return err
+	}
+	if kv.maxKeys > 0 && kv.eviction == PolicyReject {
+		if _, ok := kv.memory[key]; !ok && len(kv.memory) >= kv.maxKeys {
+			return fmt.Errorf("%w: %d keys", ErrStoreFull, kv.maxKeys)
+		}
+	}
+	return nil
+}
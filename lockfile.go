@@ -0,0 +1,28 @@
+package kv
+
+import (
+	"errors"
+	"log/slog"
+)
+
+var (
+	ErrLocked = errors.New("store is locked by another process")
+)
+
+// lockName returns the name of the lock file that keeps a second New off
+// the dump and the journal while the store is open.
+func lockName(dbName string) string {
+	return dbName + ".lock"
+}
+
+// unlockFile releases the store's lock file, if it holds it.
+func (kv *KV) unlockFile() {
+	if kv.lock == nil {
+		return
+	}
+	err := unlockFile(kv.lock)
+	if err != nil {
+		kv.logger.Error("releasing lock file failed", slog.String("op", "close"), slog.Any("error", err))
+	}
+	kv.lock = nil
+}
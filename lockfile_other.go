@@ -0,0 +1,32 @@
+//go:build !unix
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// lockFile creates the named file, failing if it exists. Unlike the flock
+// used elsewhere, the file outlives a crash, and has to be removed by hand
+// before the store can be opened again.
+func lockFile(name string, mode os.FileMode) (*os.File, error) {
+	fh, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%w: '%s'", ErrLocked, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create lock file: %w", err)
+	}
+	return fh, nil
+}
+
+// unlockFile releases a lock taken by lockFile by removing the file.
+func unlockFile(fh *os.File) error {
+	err := fh.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(fh.Name())
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the named file, creating it if
+// needed. The lock goes away with the process, so a crash doesn't leave the
+// store locked.
+func lockFile(name string, mode os.FileMode) (*os.File, error) {
+	fh, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fh.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: '%s'", ErrLocked, name)
+		}
+		return nil, fmt.Errorf("lock '%s': %w", name, err)
+	}
+	return fh, nil
+}
+
+// unlockFile releases a lock taken by lockFile. The file is left in place,
+// removing it could let two stores lock different files by the same name.
+func unlockFile(fh *os.File) error {
+	return fh.Close()
+}
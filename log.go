@@ -9,63 +9,319 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
+	"time"
 )
 
 type journal struct {
-	fh        io.WriteCloser // the underlying file handle, only used for closing.
+	fh        journalFile // the underlying file, written through bufWriter
 	bufWriter *bufio.Writer
 	name      string
+	cfg       journalConfig
+	seq       uint64 // sequence number of the last record written
+	written   int64  // size of the journal, the file and the buffered bytes
+	tuner     bufferTuner
+}
+
+// journalFile is the file the journal is written to. It's an *os.File,
+// except in tests that wrap one to watch it.
+type journalFile interface {
+	io.WriteCloser
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+// journalConfig holds the settings used when writing a journal.
+type journalConfig struct {
+	checksum      ChecksumType
+	crypt         *crypter    // encrypts the records, nil if not encrypting
+	mode          os.FileMode // permissions for a newly created journal
+	logger        *slog.Logger
+	progress      func(records int, bytes int64) // called every progressEvery records during replay
+	corruption    CorruptionPolicy               // what to do about corrupt records during replay
+	lastSeq       func(seq uint64)               // called after replay with the sequence number of the last record
+	codec         Codec                          // compresses the records, CodecNone to leave them be
+	minCompress   int                            // records smaller than this aren't compressed
+	storeID       []byte                         // stamped on new journals, and checked on replay if set
+	seed          uint32                         // mixed into the record checksums, 0 for none
+	anySeed       bool                           // replay whatever the journal's seed, for tools reading journals
+	dirSync       bool                           // fsync the directory after renaming the journal into place
+	deadline      time.Time                      // replay fails with ErrReplayTimeout after this, zero for no limit
+	adaptive      bool                           // size the buffer for the writes, see WithAdaptiveBuffer
+	archiveDir    string                         // coalesced records are copied here, empty to drop them
+	archiveKeep   int                            // archived journals kept, 0 for all
+	archiveMaxAge time.Duration                  // archived journals older than this are removed, 0 for no limit
+}
+
+// progressEvery is how many records are replayed between calls to the
+// replay progress callback.
+const progressEvery = 1000
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A journal starts with journalMagic, a version byte, the length of the
+// header as an uint16 and the gob-encoded journalHeader. Journals written
+// before the header was introduced start straight away with the records
+// and always use CRC32. Version 2 added the sequence number to the record
+// header, version 3 a CRC32 of the record header itself, so a corrupt
+// length is caught before the payload is read.
+const (
+	journalMagic   = "GKVJ"
+	journalVersion = 3
+)
+
+// journalHeader describes how the records in the journal are written.
+// Fields can be added without breaking older journals.
+type journalHeader struct {
+	Checksum ChecksumType
+	KeyID    []byte // id of the encryption key, empty if not encrypted
+	Seq      uint64 // sequence number of the record before the first one
+	Codec    Codec  // the codec of the compressed records
+	StoreID  []byte // id of the store's dump, empty in journals from before it
+	Seed     uint32 // seed of the record checksums, 0 if not seeded
+	version  byte   // the version read from the file, 0 for legacy journals
 }
 
 var (
 	ErrJournalCorrupt = errors.New("journal is corrupt")
+	ErrWrongStore     = errors.New("journal belongs to another store")
+	ErrReplayTimeout  = errors.New("journal replay deadline exceeded")
+	ErrWrongSeed      = errors.New("journal was written with another checksum seed")
 )
 
-// newJournal initiates a journal.
-// if the journal already exists, it will be opened and re-played.
-func newJournal(filename string, kv *kvMap) (journal, error) {
-
-	// check if the journal exists:
-	_, err := os.Stat(filename)
-	if err == nil {
-		err := play(filename, kv)
-		if err != nil {
-			return journal{}, fmt.Errorf("play: %w", err)
-		}
-	}
-	// journal replayed. Now create a new journal:
-	fh, err := os.Create(filename)
+// newJournal initiates a journal, numbering the records from seq+1.
+// if the journal already exists, it will be truncated, so it must be
+// replayed with play before this is called.
+func newJournal(filename string, cfg journalConfig, seq uint64) (journal, error) {
+	fh, err := createFile(filename, cfg.mode)
 	if err != nil {
 		return journal{}, fmt.Errorf("create: %w", err)
 	}
-	log.Printf("journal '%s' created", filename)
-	buffed := bufio.NewWriter(fh)
+	cfg.log().Info("journal created", slog.String("op", "create"), slog.String("file", filename))
 	j := journal{
 		name:      filename,
 		fh:        fh,
-		bufWriter: buffed,
+		bufWriter: bufio.NewWriter(fh),
+		cfg:       cfg,
+		seq:       seq,
+	}
+	err = j.writeHeader()
+	if err != nil {
+		fh.Close()
+		return journal{}, err
 	}
 	return j, nil
 }
 
+// writeHeader writes the journal header to the buffer.
+func (j *journal) writeHeader() error {
+	header, err := encodeHeader(j.cfg, j.seq)
+	if err != nil {
+		return err
+	}
+	n, err := j.bufWriter.Write(header)
+	j.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	return nil
+}
+
+// encodeHeader returns the journal header for the given config, for a
+// journal whose first record is seq+1.
+func encodeHeader(cfg journalConfig, seq uint64) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(journalHeader{Checksum: cfg.checksum, KeyID: cfg.crypt.id(), Seq: seq, Codec: cfg.codec, StoreID: cfg.storeID, Seed: cfg.seed})
+	if err != nil {
+		return nil, fmt.Errorf("encode header: %w", err)
+	}
+	header := make([]byte, len(journalMagic)+3, len(journalMagic)+3+buf.Len())
+	copy(header, journalMagic)
+	header[len(journalMagic)] = journalVersion
+	binary.BigEndian.PutUint16(header[len(journalMagic)+1:], uint16(buf.Len()))
+	return append(header, buf.Bytes()...), nil
+}
+
+// readHeader reads the journal header, if there is one. Legacy journals
+// without a header gets the default header and nothing is consumed.
+func readHeader(r *bufio.Reader) (journalHeader, error) {
+	magic, err := r.Peek(len(journalMagic))
+	if err != nil || string(magic) != journalMagic {
+		// empty or legacy journal.
+		return journalHeader{Checksum: ChecksumCRC32}, nil
+	}
+	prefix := make([]byte, len(journalMagic)+3)
+	_, err = io.ReadFull(r, prefix)
+	if err != nil {
+		return journalHeader{}, fmt.Errorf("read header: %w", err)
+	}
+	version := prefix[len(journalMagic)]
+	if version < 1 || version > journalVersion {
+		return journalHeader{}, fmt.Errorf("%w: unsupported version %d", ErrJournalCorrupt, version)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(prefix[len(journalMagic)+1:]))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return journalHeader{}, fmt.Errorf("read header: %w", err)
+	}
+	var header journalHeader
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&header)
+	if err != nil {
+		return journalHeader{}, fmt.Errorf("%w: decode header: %v", ErrJournalCorrupt, err)
+	}
+	if !header.Checksum.valid() {
+		return journalHeader{}, fmt.Errorf("%w: unknown checksum %v", ErrJournalCorrupt, header.Checksum)
+	}
+	if !header.Codec.valid() {
+		return journalHeader{}, fmt.Errorf("%w: unknown codec %v", ErrJournalCorrupt, header.Codec)
+	}
+	header.version = version
+	return header, nil
+}
+
+// recordHeaderSize returns the size of the record headers in the journal.
+func (jh journalHeader) recordHeaderSize() int {
+	switch {
+	case jh.version < 2:
+		return 5 + jh.Checksum.size()
+	case jh.version < 3:
+		return 13 + jh.Checksum.size()
+	}
+	return recordHeaderSize(jh.Checksum)
+}
+
+// decodeRecordHeader decodes a record header written in the journal's
+// version. Records from before version 2 have no sequence number, and get 0.
+// Records from before version 3 have no header checksum to verify.
+func (jh journalHeader) decodeRecordHeader(buf []byte) (Op, uint64, uint32, uint64, error) {
+	if jh.version >= 3 {
+		return jDecodeSum(buf, jh.Checksum)
+	}
+	if len(buf) != jh.recordHeaderSize() {
+		return 0, 0, 0, 0, fmt.Errorf("expected %d bytes, got %d", jh.recordHeaderSize(), len(buf))
+	}
+	if jh.version == 2 {
+		return Op(buf[0]), binary.BigEndian.Uint64(buf[1:9]), binary.BigEndian.Uint32(buf[9:13]), jh.Checksum.get(buf[13:]), nil
+	}
+	return Op(buf[0]), 0, binary.BigEndian.Uint32(buf[1:5]), jh.Checksum.get(buf[5:]), nil
+}
+
+// truncate empties the journal in place, leaving only a new header. The
+// buffered records are dropped along with the ones in the file. When
+// archiving, the records are archived and the journal replaced instead.
 func (j *journal) truncate() error {
-	err := j.close()
+	if j.cfg.archiveDir != "" {
+		err := j.flush()
+		if err != nil {
+			return err
+		}
+		return j.dropBefore(j.size(), j.seq)
+	}
+	err := j.fh.Truncate(0)
 	if err != nil {
-		return fmt.Errorf("close: %w", err)
+		return fmt.Errorf("truncate: %w", err)
+	}
+	_, err = j.fh.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("truncate: seek: %w", err)
 	}
+	j.bufWriter.Reset(j.fh)
+	j.written = 0
+	err = j.writeHeader()
+	if err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	return nil
+}
 
-	fh, err := os.Create(j.name)
+// dropBefore removes the records before the offset from the journal, keeping
+// the header and the records after it. seq is the sequence number of the
+// last record dropped. The new journal is written next to the old one and
+// renamed over it. The records dropped are archived first, if archiving.
+func (j *journal) dropBefore(off int64, seq uint64) error {
+	err := j.flush()
 	if err != nil {
-		return fmt.Errorf("truncate: create: %w", err)
+		return err
+	}
+	if j.cfg.archiveDir != "" {
+		err = j.archive(off)
+		if err != nil {
+			return err
+		}
 	}
-	buffed := bufio.NewWriter(fh)
-	j.fh = fh
-	j.bufWriter = buffed
+	src, err := os.Open(j.name)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer src.Close()
+	_, err = src.Seek(off, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	header, err := encodeHeader(j.cfg, seq)
+	if err != nil {
+		return err
+	}
+	tmp := j.name + ".tmp"
+	fh, err := createFile(tmp, j.cfg.mode)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	_, err = fh.Write(header)
+	var kept int64
+	if err == nil {
+		kept, err = io.Copy(fh, src)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("copy records: %w", err)
+	}
+	err = fh.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("close: %w", err)
+	}
+	err = j.fh.Close()
+	if err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+	err = renameFile(tmp, j.name, j.cfg.dirSync)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(j.name, os.O_WRONLY|os.O_APPEND, j.cfg.mode)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	j.fh = out
+	j.bufWriter = bufio.NewWriterSize(out, j.bufWriter.Size())
+	j.written = int64(len(header)) + kept
 	return nil
 }
 
+// size returns the size of the journal file plus the buffered bytes, as
+// counted while writing them, so it costs no syscall.
+func (j *journal) size() int64 {
+	return j.written
+}
+
 func (j *journal) delete() error {
 	err := os.Remove(j.name)
 	if err != nil {
@@ -86,6 +342,15 @@ func (j *journal) close() error {
 	return nil
 }
 
+// sync will fsync the journal file. It doesn't flush the buffer.
+func (j *journal) sync() error {
+	err := j.fh.Sync()
+	if err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
 func (j *journal) flush() error {
 	err := j.bufWriter.Flush()
 	if err != nil {
@@ -95,120 +360,407 @@ func (j *journal) flush() error {
 }
 
 type Tx struct {
-	Key   string
-	Value any
+	Key     string
+	Value   any
+	Expires time.Time // when the key expires, zero if it doesn't
+	Label   string    // the label of a checkpoint
+	Time    time.Time // when a checkpoint was written
+	seq     uint64    // sequence number from the record header, set on replay
 }
 
 // jEncode will encode the operation and return a byte slice ready to be written to the journal.
-func jEncode(op Op, length uint32, crc uint32) []byte {
-	buf := make([]byte, 9)
-	buf[0] = byte(op)
-	binary.BigEndian.PutUint32(buf[1:5], length)
-	binary.BigEndian.PutUint32(buf[5:9], crc)
-	return buf
+// It uses a CRC32 checksum, see jEncodeSum for the other checksum types.
+func jEncode(op Op, seq uint64, length uint32, crc uint32) []byte {
+	return jEncodeSum(op, seq, length, uint64(crc), ChecksumCRC32)
+}
+
+func jDecode(buf []byte) (Op, uint64, uint32, uint32, error) {
+	op, seq, length, crc, err := jDecodeSum(buf, ChecksumCRC32)
+	return op, seq, length, uint32(crc), err
 }
 
-func jDecode(buf []byte) (Op, uint32, uint32, error) {
-	if len(buf) != 9 {
-		return 0, 0, 0, fmt.Errorf("expected 9 bytes, got %d", len(buf))
+// jEncodeSum encodes a record header with a checksum of the given type.
+// The header is the op, the sequence number, the length of the payload,
+// the checksum of the payload and a CRC32 of the header up to there.
+func jEncodeSum(op Op, seq uint64, length uint32, sum uint64, c ChecksumType) []byte {
+	return jAppendSum(make([]byte, 0, recordHeaderSize(c)), op, seq, length, sum, c)
+}
+
+// jAppendSum is jEncodeSum, appending the header to dst.
+func jAppendSum(dst []byte, op Op, seq uint64, length uint32, sum uint64, c ChecksumType) []byte {
+	start := len(dst)
+	dst = append(dst, byte(op))
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	dst = binary.BigEndian.AppendUint32(dst, length)
+	var buf [8]byte
+	c.put(buf[:], sum)
+	dst = append(dst, buf[:c.size()]...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// recordHeaderSize returns the size of a record header with a checksum of
+// the given type.
+func recordHeaderSize(c ChecksumType) int {
+	return 17 + c.size()
+}
+
+// recordBufs holds the buffers the records are encoded into. The gob
+// encoders aren't reused: an encoder only describes a type the first time
+// it sends a value of it, and every record has to be decodable on its own,
+// so each record gets a new encoder writing into a pooled buffer.
+var recordBufs = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// maxPooledRecord is the largest buffer put back in recordBufs, so a few
+// huge values don't keep their buffers alive.
+const maxPooledRecord = 64 << 10
+
+// jDecodeSum decodes a record header encoded by jEncodeSum, failing with
+// ErrJournalCorrupt if the header checksum doesn't match.
+func jDecodeSum(buf []byte, c ChecksumType) (Op, uint64, uint32, uint64, error) {
+	size := recordHeaderSize(c)
+	if len(buf) != size {
+		return 0, 0, 0, 0, fmt.Errorf("expected %d bytes, got %d", size, len(buf))
+	}
+	if crc32.ChecksumIEEE(buf[:size-4]) != binary.BigEndian.Uint32(buf[size-4:]) {
+		return 0, 0, 0, 0, fmt.Errorf("%w: record header checksum mismatch", ErrJournalCorrupt)
 	}
 	op := Op(buf[0])
-	length := binary.BigEndian.Uint32(buf[1:5])
-	crc := binary.BigEndian.Uint32(buf[5:9])
-	return op, length, crc, nil
+	seq := binary.BigEndian.Uint64(buf[1:9])
+	length := binary.BigEndian.Uint32(buf[9:13])
+	sum := c.get(buf[13:])
+	return op, seq, length, sum, nil
 }
 
-// play will open the journal and replay all the transactions in it, updating the supplied kvMap
-func play(filename string, m *kvMap) error {
+// play will open the journal and replay all the transactions in it, updating the supplied kvMap.
+// It returns the number of records replayed. The checksum is taken from the
+// journal header, cfg is only used for the encryption key.
+func play(filename string, m *kvMap, cfg journalConfig) (int, error) {
+	return playFunc(filename, cfg, func(op Op, tx Tx) {
+		applyTx(*m, op, tx)
+	})
+}
+
+// applyTx applies a journal record to the map.
+func applyTx(m kvMap, op Op, tx Tx) {
+	switch op {
+	case OpSet:
+		m[tx.Key] = tx.Value
+	case OpUnset, OpExpire:
+		delete(m, tx.Key)
+	}
+}
+
+// playFunc reads the journal and calls apply for every record in it, except
+// for the checkpoints, which carry no data.
+func playFunc(filename string, cfg journalConfig, apply func(op Op, tx Tx)) (int, error) {
 	fh, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("open journal '%s': %w", filename, err)
+		return 0, fmt.Errorf("open journal '%s': %w", filename, err)
 	}
 	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat journal '%s': %w", filename, err)
+	}
+	return playReader(fh, fi.Size(), filename, cfg, func(op Op, tx Tx) {
+		if op != OpCheckpoint {
+			apply(op, tx)
+		}
+	})
+}
+
+// playReader reads the journal from r and calls apply for every record in it.
+// size is the size of the journal, used to catch corrupt record lengths, or
+// -1 if it isn't known. name is only used for logging. A corrupt record is
+// handled according to cfg.corruption.
+func playReader(src io.Reader, size int64, name string, cfg journalConfig, apply func(op Op, tx Tx)) (int, error) {
+	cr := &countingReader{r: src}
+	r := bufio.NewReader(cr)
+	// read returns how far into the journal we've got.
+	read := func() int64 { return cr.n - int64(r.Buffered()) }
+	jh, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	err = cfg.crypt.check(jh.KeyID)
+	if err != nil {
+		return 0, err
+	}
+	if len(cfg.storeID) > 0 && len(jh.StoreID) > 0 && !bytes.Equal(cfg.storeID, jh.StoreID) {
+		return 0, fmt.Errorf("%w: '%s'", ErrWrongStore, name)
+	}
+	// a journal from before the seed was set is the store's own, and is
+	// checked without one.
+	if !cfg.anySeed && jh.Seed != 0 && jh.Seed != cfg.seed {
+		return 0, fmt.Errorf("%w: '%s'", ErrWrongSeed, name)
+	}
+	records := 0
+	last := jh.Seq // sequence number of the last record read
+	var bad []byte // the bytes of the first corrupt record
+	var badErr error
 	for {
-		// first read the header, 9 bytes:
-		header := make([]byte, 9)
-		n, err := fh.Read(header)
+		// first read the header:
+		header := make([]byte, jh.recordHeaderSize())
+		n, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				log.Println("EOF on journal")
-				break
+			if err != io.ErrUnexpectedEOF {
+				return records, fmt.Errorf("read header: %w", err)
 			}
-			return fmt.Errorf("read header: %w", err)
-		}
-		if n != 9 {
-			return fmt.Errorf("read header: expected 9 bytes, got %d", n)
+			bad, badErr = header[:n], fmt.Errorf("read header: %w", err)
+			break
 		}
 		// read the operation from the first byte:
-		op, buflen, checksum, err := jDecode(header)
+		op, seq, buflen, checksum, err := jh.decodeRecordHeader(header)
+		if errors.Is(err, ErrJournalCorrupt) {
+			bad, badErr = header, err
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("decode header: %w", err)
+			return records, fmt.Errorf("decode header: %w", err)
+		}
+		op, flags := splitOp(op)
+		// a length larger than the journal itself can only be corruption,
+		// catch it before allocating the buffer:
+		if size >= 0 && int64(buflen) > size {
+			bad, badErr = header, fmt.Errorf("%w: record length %d exceeds journal size", ErrJournalCorrupt, buflen)
+			break
 		}
 		// read the buffer:
-		buf := make([]byte, buflen)
-		n, err = fh.Read(buf)
+		buf, err := readRecord(r, buflen, size >= 0)
 		if err != nil {
-			return fmt.Errorf("read buffer: %w", err)
-		}
-		if n != int(buflen) {
-			return fmt.Errorf("read buffer: expected %d bytes, got %d", buflen, n)
+			if err != io.ErrUnexpectedEOF {
+				return records, fmt.Errorf("read buffer: %w", err)
+			}
+			bad, badErr = append(header, buf...), fmt.Errorf("read buffer: %w", err)
+			break
 		}
-		// calculate the checksum of the buffer:
-		crc := crc32.ChecksumIEEE(buf)
-		if crc != checksum {
-			return ErrJournalCorrupt
+		tx, err := decodeRecord(op, flags, buf, checksum, jh, cfg)
+		if errors.Is(err, ErrJournalCorrupt) {
+			bad, badErr = append(header, buf...), err
+			break
 		}
-		// decode the buffer:
-		dec := gob.NewDecoder(bytes.NewReader(buf))
-		var tx Tx
-		err = dec.Decode(&tx)
 		if err != nil {
-			return fmt.Errorf("decode tx: %w", err)
+			return records, err
 		}
+		// a gap in the sequence means records have gone missing. The
+		// record itself is intact, so when skipping it's applied.
+		if jh.version >= 2 {
+			if seq != last+1 {
+				gapErr := fmt.Errorf("%w: record %d follows record %d", ErrJournalCorrupt, seq, last)
+				if cfg.corruption != PolicySkipRecord {
+					bad, badErr = append(header, buf...), gapErr
+					break
+				}
+				cfg.log().Warn("journal records missing", slog.String("op", "replay"), slog.String("file", name),
+					slog.Int64("offset", read()-int64(len(header)+len(buf))), slog.Any("error", gapErr))
+			}
+			last = seq
+		}
+		tx.seq = seq
 		// apply the transaction:
-		switch op {
-		case OpSet:
-			(*m)[tx.Key] = tx.Value
-		case OpUnset:
-			delete(*m, tx.Key)
+		apply(op, tx)
+		records++
+		if cfg.progress != nil && records%progressEvery == 0 {
+			cfg.progress(records, read())
+		}
+		if !cfg.deadline.IsZero() && time.Now().After(cfg.deadline) {
+			return records, fmt.Errorf("%w after %d records", ErrReplayTimeout, records)
 		}
 	}
-	return nil
+	if bad != nil {
+		switch cfg.corruption {
+		case PolicyTruncate:
+			cfg.log().Warn("corrupt journal record, discarding the rest of the journal",
+				slog.String("op", "replay"), slog.String("file", name),
+				slog.Int64("offset", read()-int64(len(bad))), slog.Any("error", badErr))
+		case PolicySkipRecord:
+			offset := read() - int64(len(bad))
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				return records, fmt.Errorf("read journal: %w", err)
+			}
+			// the corrupt record might have a bogus length, so look for
+			// the next record from the byte after where it starts.
+			data := append(bad[1:], rest...)
+			n, skipped, seq := resync(data, jh, cfg, apply)
+			records += n
+			last = max(last, seq)
+			cfg.log().Warn("corrupt journal records skipped",
+				slog.String("op", "replay"), slog.String("file", name),
+				slog.Int64("offset", offset), slog.Int("bytes", skipped+1), slog.Any("error", badErr))
+		default:
+			return records, badErr
+		}
+	}
+	if cfg.progress != nil {
+		cfg.progress(records, read())
+	}
+	if cfg.lastSeq != nil {
+		cfg.lastSeq(last)
+	}
+	cfg.log().Debug("journal replayed", slog.String("op", "replay"), slog.String("file", name), slog.Int("records", records))
+	return records, nil
 }
 
-func (j *journal) log(op Op, key string, value any) error {
-	tx := Tx{
-		Key:   key,
-		Value: value,
+// decodeRecord verifies the checksum of the record and decodes it.
+// Checksum, decryption and decompression failures are reported as
+// ErrJournalCorrupt.
+func decodeRecord(op Op, flags Op, buf []byte, checksum uint64, jh journalHeader, cfg journalConfig) (Tx, error) {
+	// calculate the checksum of the buffer:
+	if jh.Checksum.sum(buf, jh.Seed) != checksum {
+		return Tx{}, ErrJournalCorrupt
 	}
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(tx)
+	var err error
+	if len(jh.KeyID) > 0 {
+		buf, err = cfg.crypt.open(buf, []byte{byte(op)})
+		if err != nil {
+			return Tx{}, fmt.Errorf("%w: %v", ErrJournalCorrupt, err)
+		}
+	}
+	if flags&opCompressed != 0 {
+		buf, err = jh.Codec.decompress(buf)
+		if err != nil {
+			return Tx{}, fmt.Errorf("%w: %v", ErrJournalCorrupt, err)
+		}
+	}
+	if flags&opRawBytes != 0 {
+		return decodeBytesTx(buf)
+	}
+	// decode the buffer:
+	var tx Tx
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&tx)
 	if err != nil {
-		return fmt.Errorf("encode tx: %w", err)
+		return Tx{}, fmt.Errorf("decode tx: %w", err)
+	}
+	return tx, nil
+}
+
+// resync applies the valid records in data, skipping the bytes that can't
+// be the start of one. A record is only taken as valid if the operation is
+// known, the length fits and the checksum matches, so the chance of
+// mistaking garbage for a record is tiny. Gaps in the sequence are expected
+// here and not checked. It returns the number of records applied, the
+// number of bytes skipped and the highest sequence number seen.
+func resync(data []byte, jh journalHeader, cfg journalConfig, apply func(op Op, tx Tx)) (int, int, uint64) {
+	hsize := jh.recordHeaderSize()
+	records, skipped := 0, 0
+	var last uint64
+	for off := 0; off < len(data); {
+		if len(data)-off >= hsize {
+			op, seq, buflen, checksum, err := jh.decodeRecordHeader(data[off : off+hsize])
+			op, flags := splitOp(op)
+			end := off + hsize + int(buflen)
+			if err == nil && op.valid() && end >= off+hsize && end <= len(data) {
+				tx, err := decodeRecord(op, flags, data[off+hsize:end], checksum, jh, cfg)
+				if err == nil {
+					tx.seq = seq
+					apply(op, tx)
+					records++
+					last = max(last, seq)
+					off = end
+					continue
+				}
+			}
+		}
+		off++
+		skipped++
 	}
-	buflen := uint32(buf.Len())
+	return records, skipped, last
+}
+
+// readRecord reads a record of n bytes. If the length has been checked
+// against the size of the journal the buffer is allocated up front,
+// otherwise it grows as the data is read, so a corrupt length can't make
+// us allocate more than there is to read.
+func readRecord(r io.Reader, n uint32, checked bool) ([]byte, error) {
+	if checked {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// log writes a single record to the journal and returns the number of bytes written.
+func (j *journal) log(op Op, key string, value any) (int, error) {
+	return j.logTx(op, Tx{Key: key, Value: value})
+}
+
+// logTx writes the transaction to the journal and returns the number of bytes written.
+func (j *journal) logTx(op Op, tx Tx) (int, error) {
+	buf := recordBufs.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledRecord {
+			recordBufs.Put(buf)
+		}
+	}()
+	var err error
+	flag := Op(0)
+	if b, ok := rawBytes(op, tx); ok {
+		buf.Write(appendBytesTx(buf.AvailableBuffer(), tx.Key, tx.Expires, b))
+		flag = opRawBytes
+	} else {
+		err = gob.NewEncoder(buf).Encode(tx)
+		if err != nil {
+			return 0, fmt.Errorf("encode tx: %w", err)
+		}
+	}
+	payload := buf.Bytes()
+	// compress before encrypting, encrypted data doesn't compress:
+	if j.cfg.codec != CodecNone && len(payload) >= j.cfg.minCompress {
+		compressed, err := j.cfg.codec.compress(payload)
+		if err != nil {
+			return 0, err
+		}
+		// keep the raw payload if compressing didn't pay off:
+		if len(compressed) < len(payload) {
+			payload, flag = compressed, flag|opCompressed
+		}
+	}
+	if j.cfg.crypt != nil {
+		payload, err = j.cfg.crypt.seal(payload, []byte{byte(op)})
+		if err != nil {
+			return 0, fmt.Errorf("encrypt tx: %w", err)
+		}
+	}
+	buflen := uint32(len(payload))
 	// calculate the checksum of the buffer:
-	checksum := crc32.ChecksumIEEE(buf.Bytes())
+	checksum := j.cfg.checksum.sum(payload, j.cfg.seed)
 
-	// make a 9 byte buffer to hold the header.
-	header := jEncode(op, buflen, checksum)
+	// build the header in the writer's buffer, saving an allocation:
+	header := jAppendSum(j.bufWriter.AvailableBuffer(), op|flag, j.seq+1, buflen, checksum, j.cfg.checksum)
 	// write the header:
 	n, err := j.bufWriter.Write(header)
 	if err != nil {
-		return fmt.Errorf("write header: %w", err)
+		return 0, fmt.Errorf("write header: %w", err)
 	}
-	if n != 9 {
-		return fmt.Errorf("header write: expected 9 bytes, got %d", n)
+	if n != len(header) {
+		return 0, fmt.Errorf("header write: expected %d bytes, got %d", len(header), n)
 	}
 
 	// write the buffer:
-	n, err = j.bufWriter.Write(buf.Bytes())
+	n, err = j.bufWriter.Write(payload)
 	if err != nil {
-		return fmt.Errorf("write buffer: %w", err)
+		return 0, fmt.Errorf("write buffer: %w", err)
 	}
 	if n != int(buflen) {
-		return fmt.Errorf("buffer write: expected %d bytes, got %d", buflen, n)
+		return 0, fmt.Errorf("buffer write: expected %d bytes, got %d", buflen, n)
 	}
-	return nil
+	j.seq++
+	j.written += int64(len(header) + n)
+	if j.cfg.adaptive {
+		j.tune(len(header) + n)
+	}
+	return len(header) + n, nil
 }
@@ -0,0 +1,25 @@
+package kv
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record. It's the default handler, so the store
+// stays quiet unless a logger is given with WithSlog.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// log returns the logger for the journal, the discard logger if none is set.
+func (c journalConfig) log() *slog.Logger {
+	if c.logger == nil {
+		return discardLogger
+	}
+	return c.logger
+}
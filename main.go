@@ -1,14 +1,18 @@
 package kv
 
 import (
-	"encoding/gob"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Op uint8
@@ -16,23 +20,134 @@ type Op uint8
 const (
 	OpSet Op = iota + 1
 	OpUnset
+	// OpExpire removes a key whose time to live has run out. It is replayed
+	// like OpUnset, but tells an expiry apart from a delete.
+	OpExpire
+	// OpCheckpoint marks a point in the journal, see Checkpoint. It carries
+	// no data and is skipped on replay.
+	OpCheckpoint
 )
 
+// valid reports whether op is a known operation.
+func (op Op) valid() bool {
+	return op >= OpSet && op <= OpCheckpoint
+}
+
+func (op Op) String() string {
+	switch op {
+	case OpSet:
+		return "OpSet"
+	case OpUnset:
+		return "OpUnset"
+	case OpExpire:
+		return "OpExpire"
+	case OpCheckpoint:
+		return "OpCheckpoint"
+	default:
+		return fmt.Sprintf("Op(%d)", op)
+	}
+}
+
 type kvMap map[string]any
 type KV struct {
 	memory        kvMap
 	fileName      string
+	walName       string
 	journal       journal
 	mu            sync.Mutex
 	lastFlush     time.Time
 	ready         atomic.Bool
 	syncInterval  time.Duration
 	syncEvery     bool
-	autoFlushCtrl chan struct{}
+	syncJitter    float64       // fraction of syncInterval each tick is moved by, at most
+	syncWindow    time.Duration // fsync this long after the first unsynced write, 0 to not
+	windowTimer   *time.Timer   // pending sync window fsync, nil if none
+	durability    Durability
+	durabilitySet bool
+	createDirs    bool
+	dirSync       bool
+	requireWAL    bool
+	readOnly      bool          // opened with OpenSnapshot, there are no files
+	replayTimeout time.Duration // how long opening may spend replaying the journal, 0 for no limit
+	writeThrough  bool
+	bgCtrl        chan struct{} // closed on Close to stop the background goroutines
+	tracer        trace.Tracer
+	logger        *slog.Logger
+	seq           uint64 // sequence number of the last journaled record
+	dirty         bool   // changed since the last coalesce
+	group         *groupCommit
+	journalCfg    journalConfig
+	dumpCfg       dumpConfig
+	encryptionKey []byte
+	maxValueSize  int
+	maxKeys       int
+	eviction      EvictionPolicy
+	recency       *lru   // only maintained for PolicyEvictLRU
+	readers       int    // open read transactions sharing kv.memory
+	gen           uint64 // bumped every time kv.memory is copied for the readers
+	expires       map[string]time.Time
+	now           func() time.Time
+	sweepInterval time.Duration
+	bgMu          sync.Mutex
+	bgErr         error // last panic recovered in a background task
+
+	onEvict  func(key string, value any)
+	onExpire func(key string, value any)
+	removals []removal // removed keys waiting for their callbacks
+
+	auditHook func(op, key string) // nil unless auditing
+
+	coalesceEveryOps int
+	coalesceRatio    float64 // journal to dump size that starts a coalesce, 0 for none
+	dumpSize         int64   // size of the dump when it was last written
+	opsSinceCoalesce atomic.Int64
+	autoCoalescing   atomic.Bool
+	asyncCoalescing  atomic.Bool // a CoalesceAsync is running
+	coalesces        uint64      // bumped whenever the journal is emptied
+	coalesceMu       sync.Mutex  // held for the whole of a coalesce, taken before mu
+	coalesceErr      error       // error of the last coalesce, nil if it succeeded
+	history          coalesceHistory
+
+	streams []*walStream // followers getting the journaled records
+
+	equality func(a, b any) bool // compares values for AtomicUpdate, nil for reflect.DeepEqual
+
+	failOnWALError bool
+	degraded       error // the journal error that degraded the store
+
+	spillThreshold int        // values encoding to more bytes than this are spilled
+	spillFile      *spillFile // nil unless spilling
+	readCacheSize  int        // spilled values kept in readCache
+	readCache      *readCache // nil unless spilling with a read cache
+
+	lock *os.File // held while the store is open, see lockFile
+
+	writeRate      int      // writes per second, 0 for no limit
+	rejectOverRate bool     // fail writes over the rate instead of waiting
+	limiter        *limiter // nil unless writes are rate limited
+
+	walHighWater int64        // journal size that makes writers wait for a coalesce, 0 for no limit
+	walDrained   *sync.Cond   // signalled when the journal has been truncated
+	coalesce     func() error // what a background coalesce runs, Coalesce
+
+	latency   *latencyTracker // nil unless tracking latencies
+	fsyncs    uint64          // journal fsyncs, for Stats
+	fsyncTime time.Duration   // time spent in them
 }
 
+// defaultFileMode is the mode os.Create uses, before the umask.
+const defaultFileMode os.FileMode = 0o666
+
 var (
-	ErrNotReady = errors.New("kv is not ready")
+	ErrNotReady    = errors.New("kv is not ready")
+	ErrAlreadyOpen = errors.New("kv is already open")
+	ErrSameFile    = errors.New("dump and journal are the same file")
+	ErrMissingDir  = errors.New("directory does not exist")
+	ErrMissingWAL  = errors.New("dump exists but the journal is missing")
+	// ErrClosed is returned by a store that is closed, or still opening.
+	// It wraps ErrNotReady, so checking for that still works. A store
+	// that is open but degraded fails writes with ErrDegraded instead.
+	ErrClosed = fmt.Errorf("%w: closed", ErrNotReady)
 )
 
 // New will create a new KV store. The dump file will be empty, the journal will be where all
@@ -40,89 +155,364 @@ var (
 // Options:
 // - WithSyncInterval will set the interval between syncs.
 // - WithSyncEvery will set the sync to happen after every operation.
+// - WithDurability will set the durability level, overriding the two above.
+// - WithTracer will emit spans for the durable operations.
+// - WithEncryption will encrypt the dump and the journal.
+// - WithSlog will send the log messages to a structured logger.
 func New(dbName, walName string, opts ...KvOption) (*KV, error) {
+	err := checkDistinct(dbName, walName)
+	if err != nil {
+		return nil, err
+	}
+	kv := &KV{
+		fileName: dbName,
+		walName:  walName,
+		tracer:   noopTracer,
+		logger:   discardLogger,
+		group:    newGroupCommit(),
+		now:      time.Now,
+		dirSync:  true,
+		journalCfg: journalConfig{
+			mode: defaultFileMode,
+		},
+		dumpCfg: dumpConfig{
+			mode: defaultFileMode,
+		},
+	}
 
-	memory := make(kvMap)
-	// check if the dump file exists, if it exists the load the content into memory.
+	// Loop through each option
+	for _, opt := range opts {
+		// Call the option giving the instantiated
+		// *House as the argument
+		opt(kv)
+	}
+	if kv.walHighWater > 0 && kv.walHighWater < minWALHighWater {
+		return nil, fmt.Errorf("WAL high-water mark of %d bytes is below the minimum of %d", kv.walHighWater, minWALHighWater)
+	}
+	kv.resolveDurability()
+	kv.walDrained = sync.NewCond(&kv.mu)
+	kv.coalesce = kv.Coalesce
+	if kv.writeRate > 0 {
+		kv.limiter = newLimiter(kv.writeRate, kv.rejectOverRate, kv.now())
+	}
+	err = checkDirs(kv.createDirs, dbName, walName)
+	if err != nil {
+		return nil, err
+	}
+	kv.journalCfg.logger = kv.logger
+	kv.journalCfg.dirSync = kv.dirSync
+	kv.dumpCfg.dirSync = kv.dirSync
+	if kv.encryptionKey != nil {
+		c, err := newCrypter(kv.encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		kv.journalCfg.crypt = c
+		kv.dumpCfg.crypt = c
+	}
+	err = kv.open()
+	if err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// Open opens an existing store. Unlike New, it fails with an error wrapping
+// os.ErrNotExist if the dump doesn't exist, rather than starting over with
+// an empty store.
+func Open(dbName, walName string, opts ...KvOption) (*KV, error) {
 	_, err := os.Stat(dbName)
+	if err != nil {
+		return nil, fmt.Errorf("opening store '%s': %w", dbName, err)
+	}
+	return New(dbName, walName, opts...)
+}
+
+// Create creates a new, empty store. Unlike New, it fails with an error
+// wrapping os.ErrExist if the dump or the journal already exists, rather
+// than opening the store that is there.
+func Create(dbName, walName string, opts ...KvOption) (*KV, error) {
+	for _, name := range []string{dbName, walName} {
+		_, err := os.Stat(name)
+		if err == nil {
+			return nil, fmt.Errorf("creating store: '%s': %w", name, os.ErrExist)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("creating store: %w", err)
+		}
+	}
+	return New(dbName, walName, opts...)
+}
+
+// checkDistinct makes sure the dump and the journal are different files.
+// If they were the same, creating the journal would truncate the dump.
+func checkDistinct(dbName, walName string) error {
+	dbAbs, err := filepath.Abs(dbName)
+	if err != nil {
+		return fmt.Errorf("resolving '%s': %w", dbName, err)
+	}
+	walAbs, err := filepath.Abs(walName)
+	if err != nil {
+		return fmt.Errorf("resolving '%s': %w", walName, err)
+	}
+	if dbAbs == walAbs {
+		return fmt.Errorf("%w: '%s'", ErrSameFile, dbAbs)
+	}
+	// different names can still be the same file, through links:
+	dbInfo, dbErr := os.Stat(dbName)
+	walInfo, walErr := os.Stat(walName)
+	if dbErr == nil && walErr == nil && os.SameFile(dbInfo, walInfo) {
+		return fmt.Errorf("%w: '%s' and '%s'", ErrSameFile, dbName, walName)
+	}
+	return nil
+}
+
+// checkDirs makes sure the directories holding the dump and the journal
+// exist, creating them if create is set.
+func checkDirs(create bool, names ...string) error {
+	for _, name := range names {
+		dir := filepath.Dir(name)
+		if create {
+			err := os.MkdirAll(dir, 0o777)
+			if err != nil {
+				return fmt.Errorf("creating directory '%s': %w", dir, err)
+			}
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: '%s', create it or use WithCreateDirs", ErrMissingDir, dir)
+		}
+		if err != nil {
+			return fmt.Errorf("stat '%s': %w", dir, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("'%s' is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// Open will re-open a store that has been closed, loading the dump and replaying
+// the journal, so the same handle can be used again.
+func (kv *KV) Open() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.ready.Load() {
+		return ErrAlreadyOpen
+	}
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	return kv.open()
+}
+
+// open loads the dump and the journal into memory and makes the store ready.
+func (kv *KV) open() error {
+	lock, err := lockFile(lockName(kv.fileName), kv.dumpCfg.mode)
+	if err != nil {
+		return err
+	}
+	kv.lock = lock
+	opened := false
+	defer func() {
+		if opened {
+			return
+		}
+		if kv.spillFile != nil {
+			_ = kv.spillFile.close()
+			kv.spillFile = nil
+		}
+		kv.unlockFile()
+	}()
+	var keep func(value any) (any, error)
+	if kv.spillThreshold > 0 {
+		spill, err := newSpillFile(kv.fileName, kv.dumpCfg.crypt)
+		if err != nil {
+			return err
+		}
+		kv.spillFile = spill
+		keep = kv.spill
+		if kv.readCacheSize > 0 {
+			kv.readCache = newReadCache(kv.readCacheSize)
+		}
+	}
+	memory := make(kvMap, kv.dumpCfg.capacity)
+	// check if the dump file exists, if it exists the load the content into memory.
+	_, err = os.Stat(kv.fileName)
+	dumpExists := err == nil
+	expires := make(map[string]time.Time)
+	var storeID []byte
 	switch err {
 	case nil:
-		memory, err = loadFromGob(dbName)
+		memory, expires, storeID, err = loadFromGob(kv.fileName, kv.dumpCfg, keep)
 		if err != nil {
-			return nil, fmt.Errorf("loading from existing gob: %w", err)
+			return fmt.Errorf("loading from existing gob: %w", err)
 		}
 	default:
-		err = createEmptyGob(dbName)
+		storeID = newStoreID()
+		kv.dumpCfg.storeID = storeID
+		err = createEmptyGob(kv.fileName, kv.dumpCfg)
 		if err != nil {
-			return nil, fmt.Errorf("creating empty gob: %w", err)
+			return fmt.Errorf("creating empty gob: %w", err)
+		}
+	}
+	// a dump without its journal means the writes since the last coalesce
+	// are gone, if there were any.
+	_, err = os.Stat(kv.walName)
+	if dumpExists && errors.Is(err, os.ErrNotExist) {
+		if kv.requireWAL {
+			return fmt.Errorf("%w: '%s'", ErrMissingWAL, kv.walName)
 		}
+		kv.logger.Warn("journal is missing, writes since the last coalesce may be lost",
+			slog.String("op", "open"), slog.String("file", kv.walName))
+	}
+	// the new journal carries on numbering the records where this one ends.
+	var seq uint64
+	cfg := kv.journalCfg
+	cfg.lastSeq = func(last uint64) { seq = last }
+	if kv.replayTimeout > 0 {
+		cfg.deadline = time.Now().Add(kv.replayTimeout)
+	}
+	// only a journal stamped with the id of the dump may be replayed on it.
+	// A journal left without its dump is replayed on the new one.
+	cfg.storeID = nil
+	if dumpExists {
+		cfg.storeID = storeID
+	}
+	// dumps from before the id was introduced get one now.
+	if len(storeID) == 0 {
+		storeID = newStoreID()
 	}
-	journal, err := newJournal(walName, &memory)
+	kv.dumpCfg.storeID = storeID
+	kv.journalCfg.storeID = storeID
+	// check if the journal exists, if it does replay it on top of the dump:
+	_, err = os.Stat(kv.walName)
+	if err == nil {
+		var spillErr error
+		apply := func(op Op, tx Tx) {
+			if keep != nil && op == OpSet && spillErr == nil {
+				tx.Value, spillErr = keep(tx.Value)
+			}
+			applyTx(memory, op, tx)
+			if op == OpSet && !tx.Expires.IsZero() {
+				expires[tx.Key] = tx.Expires
+			} else {
+				delete(expires, tx.Key)
+			}
+		}
+		records, err := playFunc(kv.walName, cfg, apply)
+		if err == nil {
+			err = spillErr
+		}
+		if err != nil {
+			return fmt.Errorf("replaying journal: %w", err)
+		}
+		// the journal is truncated below, so the replayed records must be
+		// persisted in the dump first, and the old dump must survive a crash
+		// until the new one is in place.
+		if records > 0 {
+			err = replaceDumpFile(kv.fileName, memory, expires, kv.dumpCfg)
+			if err != nil {
+				return fmt.Errorf("dumping replayed journal: %w", err)
+			}
+		}
+	}
+	journal, err := newJournal(kv.walName, kv.journalCfg, seq)
 	if err != nil {
-		return nil, fmt.Errorf("creating journal: %w", err)
+		return fmt.Errorf("creating journal: %w", err)
 	}
-	kv := &KV{
-		fileName: dbName,
-		memory:   memory,
-		journal:  journal,
+	kv.memory = memory
+	kv.expires = expires
+	kv.readers = 0
+	kv.gen++
+	kv.coalesces++
+	kv.statDump()
+	kv.degraded = nil
+	kv.coalesceErr = nil
+	kv.dirty = false
+	kv.journal = journal
+	// values overwritten while replaying are left behind in the spill file:
+	kv.reclaimSpill()
+	if kv.maxKeys > 0 && kv.eviction == PolicyEvictLRU {
+		kv.recency = newLRU(memory)
 	}
-
-	// Loop through each option
-	for _, opt := range opts {
-		// Call the option giving the instantiated
-		// *House as the argument
-		opt(kv)
+	kv.bgCtrl = make(chan struct{})
+	if kv.durability == DurabilityFlush {
+		go kv.autoFlusher(kv.bgCtrl)
 	}
-	if kv.syncInterval > 0 {
-		kv.autoFlushCtrl = make(chan struct{})
-		go kv.autoFlusher()
+	if kv.sweepInterval > 0 {
+		go kv.sweeper(kv.bgCtrl)
 	}
+	opened = true
 	kv.ready.Store(true)
-	return kv, nil
+	return nil
 }
 
-func (kv *KV) autoFlusher() {
-	ticker := time.NewTicker(kv.syncInterval)
-	defer ticker.Stop()
-	// listen to the ticker and the control channel:
+func (kv *KV) autoFlusher(ctrl chan struct{}) {
+	rng := rand.New(rand.NewSource(kv.now().UnixNano()))
+	timer := time.NewTimer(kv.syncDelay(rng))
+	defer timer.Stop()
+	// listen to the timer and the control channel:
 	for {
 		select {
-		case <-ticker.C:
-			err := kv.Flush()
-			if err != nil {
-				log.Printf("flushing: %s", err)
-			}
-		case <-kv.autoFlushCtrl:
+		case <-timer.C:
+			timer.Reset(kv.syncDelay(rng))
+			kv.guard("sync", func() {
+				err := kv.Sync()
+				if err != nil {
+					kv.logger.Error("sync failed", slog.String("op", "sync"), slog.Any("error", err))
+				}
+			})
+		case <-ctrl:
 			return
 		}
 	}
 }
 
-func loadFromGob(dbName string) (kvMap, error) {
-	var memory kvMap
+// loadFromGob loads the dump and returns it along with the expiry deadlines
+// and the store id. If keep is set, it gets every value and returns what to
+// store in the map in its place.
+func loadFromGob(dbName string, cfg dumpConfig, keep func(value any) (any, error)) (kvMap, map[string]time.Time, []byte, error) {
 	fh, err := os.Open(dbName)
 	if err != nil {
-		return nil, fmt.Errorf("opening file '%s': %w", dbName, err)
+		return nil, nil, nil, fmt.Errorf("opening file '%s': %w", dbName, err)
 	}
 	defer fh.Close()
-	dec := gob.NewDecoder(fh)
-	err = dec.Decode(&memory)
+	var memory kvMap
+	var storeID []byte
+	expires := make(map[string]time.Time)
+	err = readDumpFunc(fh, cfg.crypt, func(n int, id []byte) {
+		memory = make(kvMap, max(n, cfg.capacity))
+		storeID = id
+	}, func(key string, value any, deadline time.Time) error {
+		if keep != nil {
+			value, err = keep(value)
+			if err != nil {
+				return fmt.Errorf("'%s': %w", key, err)
+			}
+		}
+		memory[key] = value
+		if !deadline.IsZero() {
+			expires[key] = deadline
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("decoding map: %w", err)
+		return nil, nil, nil, fmt.Errorf("reading dump: %w", err)
 	}
-	return memory, nil
+	return memory, expires, storeID, nil
 }
 
-func createEmptyGob(dbName string) error {
-	fh, err := os.Create(dbName)
+func createEmptyGob(dbName string, cfg dumpConfig) error {
+	fh, err := createFile(dbName, cfg.mode)
 	if err != nil {
 		return fmt.Errorf("creating file '%s': %w", dbName, err)
 	}
 	defer fh.Close()
-	enc := gob.NewEncoder(fh)
-	err = enc.Encode(make(kvMap))
+	err = writeDump(fh, make(kvMap), nil, cfg.crypt, cfg.storeID)
 	if err != nil {
-		return fmt.Errorf("createEmptyGob: encoding map: %w", err)
+		return fmt.Errorf("createEmptyGob: writing dump: %w", err)
 	}
 	return nil
 }
@@ -132,18 +522,22 @@ func createEmptyGob(dbName string) error {
 // journal should be deleted before or after this, while lock is kept.
 func (kv *KV) dump() error {
 	if !kv.ready.Load() {
-		return ErrNotReady
+		return ErrClosed
 	}
 
-	fh, err := os.Create(kv.fileName)
+	return replaceDumpFile(kv.fileName, kv.memory, kv.expires, kv.dumpCfg)
+}
+
+// writeDumpFile writes the map and the deadlines to the named dump file.
+func writeDumpFile(dbName string, m kvMap, expires map[string]time.Time, cfg dumpConfig) error {
+	fh, err := createFile(dbName, cfg.mode)
 	if err != nil {
 		return fmt.Errorf("creating file: %w", err)
 	}
-	// use gob to encode the map to disk:
-	enc := gob.NewEncoder(fh)
-	err = enc.Encode(kv.memory)
+	err = writeDump(fh, m, expires, cfg.crypt, cfg.storeID)
 	if err != nil {
-		return fmt.Errorf("encoding map: %w", err)
+		fh.Close()
+		return fmt.Errorf("writing dump: %w", err)
 	}
 	err = fh.Close()
 	if err != nil {
@@ -154,112 +548,376 @@ func (kv *KV) dump() error {
 
 // Coalesce will coalesce the journal into the dump file.
 // It will delete the journal after it is done and create a new one.
+// It logs how long it took at the info level, see Compact for a quiet one.
 func (kv *KV) Coalesce() error {
+	d, err := kv.Compact()
+	if errors.Is(err, ErrNotReady) {
+		return err
+	}
+	kv.logger.Info("coalesce done", slog.String("op", "coalesce"), slog.Duration("duration", d))
+	return err
+}
+
+// Compact does the work of Coalesce, returning how long it took instead of
+// logging it at the info level.
+func (kv *KV) Compact() (time.Duration, error) {
 	if !kv.ready.Load() {
-		return ErrNotReady
+		return 0, ErrClosed
+	}
+	if kv.readOnly {
+		return 0, ErrReadOnly
 	}
+	if kv.latency != nil {
+		defer kv.latency.observe(latencyCoalesce, time.Now())
+	}
+	span := kv.startSpan("kv.Coalesce")
+	defer span.End()
 	start := time.Now()
-	defer log.Printf("save took %v\n", time.Since(start))
+	// expired keys aren't worth persisting. This runs the expiry callbacks,
+	// so it's done before taking coalesceMu, which they might need.
+	kv.sweep()
+	kv.coalesceMu.Lock()
+	defer kv.coalesceMu.Unlock()
+	// Close might have got in while we waited:
+	if !kv.ready.Load() {
+		return time.Since(start), ErrClosed
+	}
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
+	// nothing has changed since the dump was written:
+	if !kv.dirty {
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return time.Since(start), nil
+	}
+	err := kv.coalesceLocked()
+	if err != nil {
+		span.RecordError(err)
+		return time.Since(start), err
+	}
+	if fi, err := os.Stat(kv.fileName); err == nil && span.IsRecording() {
+		span.SetAttributes(attribute.Int64("bytes", fi.Size()))
+	}
+	d := time.Since(start)
+	kv.logger.Debug("compact done", slog.String("op", "compact"), slog.Duration("duration", d))
+	return d, nil
+}
+
+// coalesceLocked writes the dump and truncates the journal. It assumes kv is locked.
+func (kv *KV) coalesceLocked() error {
+	start := time.Now()
+	walBefore := kv.journal.size()
 	// persist the kv.memory map to disk
 	err := kv.dump()
 	if err != nil {
-		return fmt.Errorf("dumping memory: %w", err)
+		kv.coalesceErr = fmt.Errorf("dumping memory: %w", err)
+		return kv.coalesceErr
 	}
-
 	err = kv.journal.truncate()
 	if err != nil {
-		return fmt.Errorf("truncating journal: %w", err)
+		kv.coalesceErr = fmt.Errorf("truncating journal: %w", err)
+		return kv.coalesceErr
 	}
+	kv.coalesceErr = nil
+	kv.opsSinceCoalesce.Store(0)
+	kv.coalesces++
+	kv.dirty = false
+	kv.walDrained.Broadcast()
+	kv.recordCoalesce(start, walBefore)
 	return nil
 }
 
-// Flush will flush the journal to disk.
-// note that it currently doesn't flush the page cache to disk.
+// IsDirty reports whether the store has changed since it was last coalesced.
+// Coalescing a store that isn't dirty does nothing.
+func (kv *KV) IsDirty() bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.dirty
+}
+
+// Flush will flush the journal buffer to the OS.
+// note that it doesn't flush the page cache to disk, use Sync for that.
 func (kv *KV) Flush() error {
+	_, err := kv.FlushN()
+	return err
+}
+
+// FlushN is Flush, returning the number of buffered bytes written to the OS.
+func (kv *KV) FlushN() (int, error) {
 	if !kv.ready.Load() {
-		return ErrNotReady
-	}
-	err := kv.journal.bufWriter.Flush()
-	if err != nil {
-		return fmt.Errorf("flush: %w", err)
+		return 0, ErrClosed
 	}
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
+	return kv.flushLocked()
+}
+
+// flushLocked flushes the journal buffer and returns the number of bytes
+// flushed. It assumes kv is locked.
+func (kv *KV) flushLocked() (int, error) {
+	if kv.readOnly {
+		return 0, nil
+	}
+	if kv.latency != nil {
+		defer kv.latency.observe(latencyFlush, time.Now())
+	}
+	bytes := kv.journal.bufWriter.Buffered()
+	span := kv.startSpan("kv.Flush")
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("bytes", bytes))
+	}
+	defer span.End()
+	start := time.Now()
+	err := kv.journal.flush()
+	if err != nil {
+		err = kv.walFailed(err)
+		span.RecordError(err)
+		return 0, err
+	}
 	kv.lastFlush = time.Now()
-	return nil
+	kv.logger.Debug("flush done", slog.String("op", "flush"),
+		slog.Int("bytes", bytes), slog.Duration("duration", kv.lastFlush.Sub(start)))
+	return bytes, nil
+}
+
+// Sync flushes the journal buffer and fsyncs the journal file, so that
+// everything written so far survives a crash. Unlike Flush, it waits for
+// the data to reach stable storage, which makes it a lot slower.
+func (kv *KV) Sync() error {
+	_, err := kv.syncSeq()
+	return err
 }
 
 // Close closes the journal, doesn't save a new dump.
+// Calling Close on a store that is already closed does nothing and returns nil.
+// A coalesce that's under way, also one started by CoalesceAsync, is
+// finished before the journal is closed.
 func (kv *KV) Close() error {
-	if !kv.ready.Load() {
-		return ErrNotReady
+	// flip ready first, so only one caller gets to close the journal.
+	if !kv.ready.CompareAndSwap(true, false) {
+		return nil
 	}
+	close(kv.bgCtrl)
 	start := time.Now()
 	defer func() {
-		log.Printf("close took %v\n", time.Since(start))
+		kv.logger.Info("close done", slog.String("op", "close"), slog.Duration("duration", time.Since(start)))
 	}()
+	// let a coalesce that's under way finish before the journal is closed.
+	// The ones that haven't started see the store isn't ready and give up.
+	kv.coalesceMu.Lock()
+	defer kv.coalesceMu.Unlock()
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
+	defer kv.unlockFile()
+	for _, s := range kv.streams {
+		s.stop()
+	}
+	kv.streams = nil
+	if kv.windowTimer != nil {
+		kv.windowTimer.Stop()
+		kv.windowTimer = nil
+	}
+	// wake the writers waiting for the journal to shrink:
+	kv.walDrained.Broadcast()
+	if kv.readOnly {
+		return nil
+	}
 	err := kv.journal.close()
 	if err != nil {
 		return fmt.Errorf("closing journal: %w", err)
 	}
-	kv.ready.Store(false)
+	if kv.spillFile != nil {
+		err = kv.spillFile.close()
+		kv.spillFile = nil
+		kv.readCache = nil
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Set sets the value of the key and journals it. Values are encoded with
+// encoding/gob, so types other than the basic ones must be registered with
+// gob.Register. gob encodes a value implementing encoding.BinaryMarshaler
+// and BinaryUnmarshaler as the bytes MarshalBinary returns, tagged with the
+// registered name of the type, which gives a type control of its own
+// format in the journal and the dump.
 func (kv *KV) Set(key string, value any) error {
 	if kv.ready.Load() == false {
-		return ErrNotReady
+		return ErrClosed
+	}
+	kv.audit("set", key)
+	if kv.latency != nil {
+		defer kv.latency.observe(latencySet, time.Now())
+	}
+	span := kv.startSpan("kv.Set")
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("key", key), attribute.String("op", "set"))
+	}
+	defer span.End()
+	err := kv.checkValue(key, value)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	err = kv.beforeWrite(1)
+	if err != nil {
+		span.RecordError(err)
+		return err
 	}
 	kv.mu.Lock()
-	kv.memory[key] = value
-	kv.mu.Unlock()
-	// persist the key to disk:
-	err := kv.journal.log(OpSet, key, value)
+	err = kv.admit(key)
 	if err != nil {
-		log.Printf("error persisting key '%s': %v", key, err)
+		kv.unlock()
+		span.RecordError(err)
+		return err
 	}
-	// if syncInterval is set, flush the journal every syncInterval:
-	if (kv.syncInterval > 0 && time.Since(kv.lastFlush) > kv.syncInterval) || kv.syncEvery {
-		err := kv.Flush()
-		if err != nil {
-			log.Printf("error flushing journal: %v", err)
+	stored, err := kv.spill(value)
+	if err != nil {
+		kv.unlock()
+		span.RecordError(err)
+		return err
+	}
+	// persist the key to disk:
+	n, err := kv.logOp(OpSet, key, value)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("bytes", n))
+	}
+	if err != nil {
+		span.RecordError(err)
+		if kv.failOnWALError || kv.writeThrough {
+			kv.unlock()
+			return err
 		}
+		kv.logger.Error("journaling failed", slog.String("op", "set"), slog.String("key", key), slog.Any("error", err))
+	}
+	kv.mutable()
+	kv.memory[key] = stored
+	delete(kv.expires, key)
+	kv.touch(key)
+	kv.reclaimSpill()
+	seq := kv.seq
+	kv.unlock()
+	// flush and sync the journal if the durability level asks for it:
+	err = kv.settle(seq, slog.String("op", "set"), slog.String("key", key))
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
 func (kv *KV) Unset(key string) (bool, error) {
 	if kv.ready.Load() == false {
-		return false, ErrNotReady
+		return false, ErrClosed
+	}
+	kv.audit("unset", key)
+	err := kv.beforeWrite(1)
+	if err != nil {
+		return false, err
 	}
 	kv.mu.Lock()
 	_, ok := kv.memory[key]
 	// it doesn't exist in memory, so no need to log the deletion.
 	if !ok {
+		kv.unlock()
 		return true, nil
 	}
-	kv.mu.Unlock()
-	// persist the deletion to disk:
-	err := kv.journal.log(OpUnset, key, nil)
+	// remove the key and persist the deletion to disk:
+	err = kv.unsetLocked(key)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return true, err
+	}
+	err = kv.settle(seq, slog.String("op", "unset"), slog.String("key", key))
 	if err != nil {
-		return true, fmt.Errorf("journaling: %w", err)
+		return true, err
 	}
 	return true, nil
 }
 
+// setLocked stores the value in memory and journals it. It assumes kv is locked.
+func (kv *KV) setLocked(key string, value any) error {
+	return kv.setExpiringLocked(key, value, time.Time{})
+}
+
+// setExpiringLocked is setLocked for a key that expires at deadline, or
+// doesn't expire if the deadline is zero. It assumes kv is locked.
+func (kv *KV) setExpiringLocked(key string, value any, deadline time.Time) error {
+	// the value might come from another store's map:
+	value, err := unspill(value)
+	if err != nil {
+		return err
+	}
+	err = kv.checkValue(key, value)
+	if err != nil {
+		return err
+	}
+	err = kv.admit(key)
+	if err != nil {
+		return err
+	}
+	stored, err := kv.spill(value)
+	if err != nil {
+		return err
+	}
+	_, err = kv.logTx(OpSet, Tx{Key: key, Value: value, Expires: deadline})
+	if err != nil {
+		return fmt.Errorf("journaling: %w", err)
+	}
+	kv.mutable()
+	kv.memory[key] = stored
+	if deadline.IsZero() {
+		delete(kv.expires, key)
+	} else {
+		kv.expires[key] = deadline
+	}
+	kv.touch(key)
+	kv.reclaimSpill()
+	return nil
+}
+
+// unsetLocked removes the key from memory and journals it. It assumes kv is locked.
+func (kv *KV) unsetLocked(key string) error {
+	_, err := kv.logOp(OpUnset, key, nil)
+	if err != nil {
+		return fmt.Errorf("journaling: %w", err)
+	}
+	kv.mutable()
+	delete(kv.memory, key)
+	delete(kv.expires, key)
+	kv.forget(key)
+	return nil
+}
+
 func (kv *KV) Get(key string) (any, bool, error) {
 	if kv.ready.Load() == false {
-		return nil, false, ErrNotReady
+		return nil, false, ErrClosed
+	}
+	kv.audit("get", key)
+	if kv.latency != nil {
+		defer kv.latency.observe(latencyGet, time.Now())
 	}
 	kv.mu.Lock()
-	defer kv.mu.Unlock()
+	defer kv.unlock()
 	if kv.memory == nil {
 		kv.memory = make(kvMap)
 	}
 	val, ok := kv.memory[key]
-	return val, ok, nil
+	if ok && kv.expired(key) {
+		err := kv.expireLocked(key)
+		if err != nil {
+			kv.logger.Error("expiring failed", slog.String("op", "expire"), slog.String("key", key), slog.Any("error", err))
+		}
+		return nil, false, nil
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	kv.touch(key)
+	val, err := kv.loadCached(key, val)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
 }
@@ -1,9 +1,34 @@
 package kv
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestMain(m *testing.M) {
@@ -13,7 +38,7 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 	res := m.Run()
-	err = deleteFiles("test.db", "test.wal")
+	err = deleteFiles("test.db", "test.wal", "test.db.lock")
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -22,14 +47,17 @@ func TestMain(m *testing.M) {
 }
 
 func TestEncodeDecode(t *testing.T) {
-	header1 := jEncode(OpSet, 42, 2424)
-	op, key, value, err := jDecode(header1)
+	header1 := jEncode(OpSet, 7, 42, 2424)
+	op, seq, key, value, err := jDecode(header1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if op != OpSet {
 		t.Fatalf("expected OpSet, got %d", op)
 	}
+	if seq != 7 {
+		t.Fatalf("expected sequence 7, got %d", seq)
+	}
 	if key != 42 {
 		t.Fatalf("expected key 42, got %d", key)
 	}
@@ -48,6 +76,17 @@ func deleteFiles(files ...string) error {
 	return nil
 }
 
+// newTestKV creates a KV store backed by files in a temporary directory.
+func newTestKV(t testing.TB, opts ...KvOption) *KV {
+	t.Helper()
+	dir := t.TempDir()
+	kv, err := New(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
 // TestBasic goes through the basic operations of the KV store.
 // It creates a new KV store, sets a value, flushes the journal,
 // closes the store, reopens it, and checks that the value is
@@ -118,8 +157,9 @@ func TestNewKV(t *testing.T) {
 		t.Fatal("creating kv:", err)
 	}
 	if kv == nil {
-		t.Error("kv is nil")
+		t.Fatal("kv is nil")
 	}
+	defer kv.Close()
 	kv.Set("foo", 1)
 	foo, ok, err := kv.Get("foo")
 	if err != nil {
@@ -206,3 +246,4102 @@ func Test_Journaling(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestTracerCoalesce(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	kv := newTestKV(t, WithTracer(tp.Tracer("test")))
+	defer kv.Close()
+	err := kv.Set("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, span := range rec.Ended() {
+		if span.Name() == "kv.Coalesce" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("no span recorded for Coalesce")
+	}
+}
+
+func TestTracerSetAttributes(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	kv := newTestKV(t, WithTracer(tp.Tracer("test")))
+	defer kv.Close()
+	err := kv.Set("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := rec.Ended()
+	if len(spans) != 1 || spans[0].Name() != "kv.Set" {
+		t.Fatalf("recorded %d spans, want one for Set", len(spans))
+	}
+	attrs := make(map[string]bool)
+	for _, attr := range spans[0].Attributes() {
+		attrs[string(attr.Key)] = true
+	}
+	if !attrs["key"] || !attrs["op"] || !attrs["bytes"] {
+		t.Errorf("Set span has attributes %v", spans[0].Attributes())
+	}
+}
+
+func TestNoTracerNoSpan(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are off with the race detector")
+	}
+	kv := newTestKV(t)
+	defer kv.Close()
+	allocs := testing.AllocsPerRun(100, func() {
+		span := kv.startSpan("kv.Set")
+		if span.IsRecording() {
+			t.Fatal("span records without a tracer")
+		}
+		span.End()
+	})
+	if allocs != 0 {
+		t.Errorf("a span without a tracer takes %v allocations", allocs)
+	}
+}
+
+func TestExportImportJSON(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("str", "hello")
+	_ = kv.Set("num", 42)
+	path := filepath.Join(t.TempDir(), "export.json")
+	err := kv.ExportJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv2 := newTestKV(t)
+	defer kv2.Close()
+	_ = kv2.Set("old", true)
+	err = kv2.ImportJSON(path, ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, ok, _ := kv2.Get("str")
+	if !ok || str != "hello" {
+		t.Errorf("str is %v, want hello", str)
+	}
+	// json numbers come back as float64:
+	num, ok, _ := kv2.Get("num")
+	if !ok || num != float64(42) {
+		t.Errorf("num is %v (%T), want float64(42)", num, num)
+	}
+	_, ok, _ = kv2.Get("old")
+	if ok {
+		t.Error("old should have been removed by ImportReplace")
+	}
+}
+
+func TestImportJSONMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.json")
+	err := os.WriteFile(path, []byte(`{"list":[1,"two"],"obj":{"a":1}}`), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	kv, err := New(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("keep", 1)
+	err = kv.ImportJSON(path, ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the import must survive a replay of the journal:
+	kv, err = New(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	for _, key := range []string{"keep", "list", "obj"} {
+		if _, ok, _ := kv.Get(key); !ok {
+			t.Errorf("%s not found after reopen", key)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ConflictPolicy
+		want    any
+		wantErr error
+	}{
+		{name: "overwrite", policy: ConflictOverwrite, want: "other"},
+		{name: "keep existing", policy: ConflictKeepExisting, want: "mine"},
+		{name: "error", policy: ConflictError, want: "mine", wantErr: ErrConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newTestKV(t)
+			defer kv.Close()
+			other := newTestKV(t)
+			defer other.Close()
+			_ = kv.Set("shared", "mine")
+			_ = other.Set("shared", "other")
+			_ = other.Set("new", 1)
+			err := kv.Merge(other, tt.policy)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			val, _, _ := kv.Get("shared")
+			if val != tt.want {
+				t.Errorf("shared is %v, want %v", val, tt.want)
+			}
+			_, ok, _ := kv.Get("new")
+			if ok != (tt.wantErr == nil) {
+				t.Errorf("new present: %v", ok)
+			}
+		})
+	}
+}
+
+func TestMergeExpiry(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	other := newTestKV(t, WithClock(clock.Now))
+	defer other.Close()
+	_ = other.SetWithTTL("ttl", 1, time.Hour)
+	_ = other.SetWithTTL("gone", 2, time.Minute)
+	clock.Advance(2 * time.Minute)
+	if err := kv.Merge(other, ConflictError); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.memory["gone"]; ok {
+		t.Error("an expired key was merged")
+	}
+	// the deadline is journaled along with the value:
+	_ = kv.Close()
+	kv, err := New(kv.fileName, kv.walName, WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if _, ok, _ := kv.Get("ttl"); !ok {
+		t.Fatal("ttl wasn't merged")
+	}
+	clock.Advance(time.Hour)
+	if _, ok, _ := kv.Get("ttl"); ok {
+		t.Error("ttl lost its deadline in the merge")
+	}
+}
+
+func TestExpiredKeysHidden(t *testing.T) {
+	clock := newFakeClock()
+	a := newTestKV(t, WithClock(clock.Now))
+	defer a.Close()
+	b := newTestKV(t, WithClock(clock.Now))
+	defer b.Close()
+	_ = a.SetWithTTL("gone", 1, time.Minute)
+	tx, err := a.ReadTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	clock.Advance(time.Minute)
+	if _, ok, _ := tx.Get("gone"); ok {
+		t.Error("ReadTx.Get returned an expired key")
+	}
+	if keys, _ := tx.Keys(); len(keys) != 0 {
+		t.Errorf("ReadTx.Keys returned %v", keys)
+	}
+	added, removed, changed, err := Diff(a, b)
+	if err != nil || len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf("Diff found %v %v %v, %v", added, removed, changed, err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := newTestKV(t)
+	defer a.Close()
+	b := newTestKV(t)
+	defer b.Close()
+	_ = a.Set("same", []int{1, 2})
+	_ = b.Set("same", []int{1, 2})
+	_ = a.Set("changed", 1)
+	_ = b.Set("changed", 2)
+	_ = a.Set("removed", true)
+	_ = b.Set("added", true)
+	added, removed, changed, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []string{"added"}) {
+		t.Errorf("added is %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"removed"}) {
+		t.Errorf("removed is %v", removed)
+	}
+	if !reflect.DeepEqual(changed, []string{"changed"}) {
+		t.Errorf("changed is %v", changed)
+	}
+}
+
+func TestDoubleClose(t *testing.T) {
+	kv := newTestKV(t, WithSyncInterval(time.Millisecond))
+	err := kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	// the store is still closed for business:
+	err = kv.Set("foo", 1)
+	if !errors.Is(err, ErrNotReady) {
+		t.Errorf("set after close: got %v, want ErrNotReady", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("foo", 1)
+	err := kv.Open()
+	if !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("open on open store: got %v, want ErrAlreadyOpen", err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	val, ok, err := kv.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || val != 1 {
+		t.Errorf("foo is %v, want 1", val)
+	}
+}
+
+func TestDurabilityResolve(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []KvOption
+		want Durability
+	}{
+		{name: "default", want: DurabilityBuffered},
+		{name: "sync every", opts: []KvOption{WithSyncEvery()}, want: DurabilitySync},
+		{name: "sync interval", opts: []KvOption{WithSyncInterval(time.Hour)}, want: DurabilityFlush},
+		{name: "explicit wins", opts: []KvOption{WithSyncEvery(), WithDurability(DurabilityNone)}, want: DurabilityNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newTestKV(t, tt.opts...)
+			defer kv.Close()
+			if kv.durability != tt.want {
+				t.Errorf("durability is %v, want %v", kv.durability, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurabilityLevels(t *testing.T) {
+	tests := []struct {
+		level     Durability
+		wantWAL   bool // whether the write should be in the WAL file without a Flush
+		wantSyncs int32
+	}{
+		{level: DurabilityNone, wantWAL: false, wantSyncs: 0},
+		{level: DurabilityBuffered, wantWAL: false, wantSyncs: 0},
+		// the first write is due, the interval isn't up for the others.
+		{level: DurabilityFlush, wantWAL: true, wantSyncs: 1},
+		{level: DurabilitySync, wantWAL: true, wantSyncs: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			kv := newTestKV(t, WithDurability(tt.level), WithSyncInterval(time.Hour))
+			defer kv.Close()
+			spy := &spyFile{File: kv.journal.fh.(*os.File)}
+			kv.journal.fh = spy
+			for i := 0; i < 3; i++ {
+				err := kv.Set(fmt.Sprintf("k%d", i), i)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			fi, err := os.Stat(kv.walName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (fi.Size() > 0) != tt.wantWAL {
+				t.Errorf("WAL size is %d", fi.Size())
+			}
+			if n := spy.syncs.Load(); n != tt.wantSyncs {
+				t.Errorf("%d fsyncs for 3 writes, want %d", n, tt.wantSyncs)
+			}
+		})
+	}
+}
+
+func TestDurabilityNoneJournalsNothing(t *testing.T) {
+	kv := newTestKV(t, WithDurability(DurabilityNone))
+	_ = kv.Set("foo", 1)
+	err := kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	records, err := play(kv.walName, &m, journalConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 0 {
+		t.Errorf("WAL has %d records, want 0", records)
+	}
+}
+
+func TestGroupCommitConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	kv, err := New(db, wal, WithDurability(DurabilitySync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = kv.Set(fmt.Sprintf("key-%d-%d", i, j), j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = New(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if len(kv.memory) != 8*50 {
+		t.Errorf("got %d keys after replay, want %d", len(kv.memory), 8*50)
+	}
+}
+
+func TestDumpLegacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	// write a version 1 dump, a bare gob-encoded map:
+	fh, err := os.Create(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(fh).Encode(kvMap{"foo": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	kv, err := New(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	val, ok, _ := kv.Get("foo")
+	if !ok || val != 1 {
+		t.Errorf("foo is %v, want 1", val)
+	}
+}
+
+func TestDumpStreamingAllocs(t *testing.T) {
+	m := make(kvMap)
+	for i := 0; i < 50000; i++ {
+		m[fmt.Sprintf("key-%d", i)] = strings.Repeat("x", 100)
+	}
+	var legacy, stream bytes.Buffer
+	err := gob.NewEncoder(&legacy).Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeDump(&stream, m, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// peak samples the heap while loading the dump. The GC is made very
+	// aggressive so the heap size tracks what is actually live.
+	peak := func(buf []byte) uint64 {
+		defer debug.SetGCPercent(debug.SetGCPercent(1))
+		runtime.GC()
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(sample)
+		base := sample[0].Value.Uint64()
+		var max atomic.Uint64
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				metrics.Read(s)
+				if v := s[0].Value.Uint64(); v > max.Load() {
+					max.Store(v)
+				}
+				runtime.Gosched()
+			}
+		}()
+		got, err := readDump(bytes.NewReader(buf), nil)
+		close(done)
+		<-stopped
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(m) {
+			t.Fatalf("got %d keys, want %d", len(got), len(m))
+		}
+		return max.Load() - base
+	}
+	legacyPeak := peak(legacy.Bytes())
+	streamPeak := peak(stream.Bytes())
+	t.Logf("legacy: %d bytes, streaming: %d bytes", legacyPeak, streamPeak)
+	// the legacy format reads the whole encoded map into a buffer before decoding it.
+	if streamPeak >= legacyPeak {
+		t.Errorf("streaming load peaked at %d bytes, legacy at %d", streamPeak, legacyPeak)
+	}
+}
+
+func TestChecksumCRC64(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	kv, err := New(db, wal, WithChecksum(ChecksumCRC64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("foo", 1)
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replay with the default option, the header decides the algorithm:
+	m := make(kvMap)
+	records, err := play(wal, &m, journalConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 || m["foo"] != 1 {
+		t.Errorf("replayed %d records, foo is %v", records, m["foo"])
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	wal := filepath.Join(dir, "test.wal")
+	j, err := newJournal(wal, journalConfig{checksum: ChecksumCRC64, mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = j.log(OpSet, "foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = j.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rewrite the header to claim CRC32 while the records use CRC64:
+	buf, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header32, err := encodeHeader(journalConfig{checksum: ChecksumCRC32}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header64, err := encodeHeader(journalConfig{checksum: ChecksumCRC64}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(header32, buf[len(header64):]...)
+	err = os.WriteFile(wal, buf, 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	_, err = play(wal, &m, journalConfig{})
+	if err == nil {
+		t.Fatal("expected replay to fail")
+	}
+	if len(m) != 0 {
+		t.Errorf("corrupt record was applied: %v", m)
+	}
+}
+
+// TestReplayIsPersisted checks that records replayed from the journal
+// survive the journal being recreated on open.
+func TestReplayIsPersisted(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("foo", 1)
+	for i := 0; i < 2; i++ {
+		err := kv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = kv.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer kv.Close()
+	val, ok, _ := kv.Get("foo")
+	if !ok || val != 1 {
+		t.Errorf("foo is %v, want 1", val)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	kv, err := New(db, wal, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("dumped", "top secret")
+	err = kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("journaled", "top secret")
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{db, wal} {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte("top secret")) {
+			t.Errorf("%s contains plain text", name)
+		}
+	}
+
+	kv, err = New(db, wal, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"dumped", "journaled"} {
+		val, _, _ := kv.Get(k)
+		if val != "top secret" {
+			t.Errorf("%s is %v, want top secret", k, val)
+		}
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(db, wal, WithEncryption(bytes.Repeat([]byte{2}, 32)))
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong key: got %v, want ErrWrongKey", err)
+	}
+	_, err = New(db, wal)
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("no key: got %v, want ErrWrongKey", err)
+	}
+}
+
+func TestEncryptedJournalWrongKey(t *testing.T) {
+	wal := filepath.Join(t.TempDir(), "test.wal")
+	c, err := newCrypter(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJournal(wal, journalConfig{crypt: c, mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = j.log(OpSet, "foo", 1)
+	_ = j.close()
+	other, err := newCrypter(bytes.Repeat([]byte{2}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	_, err = play(wal, &m, journalConfig{crypt: other})
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("got %v, want ErrWrongKey", err)
+	}
+}
+
+func TestEncryptedDumpChunks(t *testing.T) {
+	c, err := newCrypter(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	for i := 0; i < 1000; i++ {
+		m[fmt.Sprintf("key-%d", i)] = strings.Repeat("x", 500)
+	}
+	var buf bytes.Buffer
+	err = writeDump(&buf, m, nil, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readDump(bytes.NewReader(buf.Bytes()), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Error("dump didn't round-trip")
+	}
+	// chopping off the end must be detected:
+	_, err = readDump(bytes.NewReader(buf.Bytes()[:buf.Len()-100]), c)
+	if err == nil {
+		t.Error("truncated dump was accepted")
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	limit, err := encodedSize(strings.Repeat("x", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newTestKV(t, WithMaxValueSize(limit))
+	defer kv.Close()
+	err = kv.Set("under", strings.Repeat("x", 100))
+	if err != nil {
+		t.Errorf("value at the limit: %v", err)
+	}
+	err = kv.Set("over", strings.Repeat("x", 101))
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("value over the limit: got %v, want ErrValueTooLarge", err)
+	}
+	if _, ok, _ := kv.Get("over"); ok {
+		t.Error("oversized value was stored")
+	}
+}
+
+func TestMaxKeysReject(t *testing.T) {
+	kv := newTestKV(t, WithMaxKeys(3, PolicyReject))
+	defer kv.Close()
+	for i := 0; i < 3; i++ {
+		err := kv.Set(fmt.Sprintf("key-%d", i), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := kv.Set("key-3", 3)
+	if !errors.Is(err, ErrStoreFull) {
+		t.Errorf("got %v, want ErrStoreFull", err)
+	}
+	// overwriting an existing key is fine:
+	err = kv.Set("key-0", 42)
+	if err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+}
+
+func TestMaxKeysEvictLRU(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	kv, err := New(db, wal, WithMaxKeys(3, PolicyEvictLRU))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	// key-0 is now the most recently used, making key-1 the oldest:
+	_, _, _ = kv.Get("key-0")
+	err = kv.Set("key-3", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := kv.Get("key-1"); ok {
+		t.Error("key-1 should have been evicted")
+	}
+	for _, key := range []string{"key-0", "key-2", "key-3"} {
+		if _, ok, _ := kv.Get(key); !ok {
+			t.Errorf("%s should still be present", key)
+		}
+	}
+	// the eviction must be journaled:
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = New(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if _, ok, _ := kv.Get("key-1"); ok {
+		t.Error("key-1 came back after replay")
+	}
+}
+
+func TestReadTx(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	_ = kv.Set("bar", 2)
+	tx, err := kv.ReadTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("foo", 42)
+	_, _ = kv.Unset("bar")
+	_ = kv.Set("baz", 3)
+
+	val, ok, err := tx.Get("foo")
+	if err != nil || !ok || val != 1 {
+		t.Errorf("tx foo is %v, want 1", val)
+	}
+	ok, _ = tx.Has("bar")
+	if !ok {
+		t.Error("tx should still see bar")
+	}
+	keys, _ := tx.Keys()
+	if !reflect.DeepEqual(keys, []string{"bar", "foo"}) {
+		t.Errorf("tx keys are %v", keys)
+	}
+	val, _, _ = kv.Get("foo")
+	if val != 42 {
+		t.Errorf("store foo is %v, want 42", val)
+	}
+	err = tx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = tx.Get("foo")
+	if !errors.Is(err, ErrTxClosed) {
+		t.Errorf("get on closed tx: got %v, want ErrTxClosed", err)
+	}
+}
+
+func TestWALSize(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	header, err := encodeHeader(kv.journalCfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := kv.WALSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(header)) {
+		t.Errorf("empty WAL is %d bytes, want %d", size, len(header))
+	}
+	prev := size
+	for i := 0; i < 3; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+		size, _ = kv.WALSize()
+		if size <= prev {
+			t.Errorf("WAL size didn't grow: %d -> %d", prev, size)
+		}
+		prev = size
+	}
+	_ = kv.Flush()
+	size, _ = kv.WALSize()
+	if size != prev {
+		t.Errorf("flush changed the WAL size: %d -> %d", prev, size)
+	}
+	err = kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new header carries on from the last record:
+	header, err = encodeHeader(kv.journalCfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ = kv.WALSize()
+	if size != int64(len(header)) {
+		t.Errorf("WAL is %d bytes after Coalesce, want %d", size, len(header))
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.db")
+	_, err := New(name, filepath.Join(dir, ".", "test.db"))
+	if !errors.Is(err, ErrSameFile) {
+		t.Errorf("got %v, want ErrSameFile", err)
+	}
+	// a symlink to the dump is the same file too:
+	err = createEmptyGob(name, dumpConfig{mode: defaultFileMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "test.wal")
+	err = os.Symlink(name, link)
+	if err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	_, err = New(name, link)
+	if !errors.Is(err, ErrSameFile) {
+		t.Errorf("symlink: got %v, want ErrSameFile", err)
+	}
+}
+
+// fakeClock is a manually advanced clock for testing expiry.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// journalOps returns the ops recorded in the journal file.
+func journalOps(t *testing.T, wal string) []Op {
+	t.Helper()
+	var ops []Op
+	_, err := playFunc(wal, journalConfig{}, func(op Op, tx Tx) {
+		ops = append(ops, op)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+func TestExpireJournalsOpExpire(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	err := kv.SetWithTTL("foo", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = kv.Unset("missing")
+	_, ok, _ := kv.Get("foo")
+	if !ok {
+		t.Fatal("foo expired too early")
+	}
+	clock.Advance(time.Minute)
+	_, ok, _ = kv.Get("foo")
+	if ok {
+		t.Fatal("foo should have expired")
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := journalOps(t, kv.walName)
+	if !reflect.DeepEqual(ops, []Op{OpSet, OpExpire}) {
+		t.Errorf("journal has ops %v, want [OpSet OpExpire]", ops)
+	}
+}
+
+func TestSetWithDeadline(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now), WithExpirySweep(time.Millisecond))
+	defer kv.Close()
+	deadline := clock.Now().Add(time.Minute)
+	_ = kv.SetWithDeadline("read", 1, deadline)
+	_ = kv.SetWithDeadline("swept", 2, deadline)
+	if err := kv.SetWithDeadline("zero", 3, time.Time{}); err == nil {
+		t.Error("a zero deadline was accepted")
+	}
+	clock.Advance(time.Minute - time.Second)
+	if _, ok, _ := kv.Get("read"); !ok {
+		t.Fatal("read expired before the deadline")
+	}
+	clock.Advance(time.Second)
+	if _, ok, _ := kv.Get("read"); ok {
+		t.Error("read outlived the deadline")
+	}
+	wait := time.Now().Add(5 * time.Second)
+	for {
+		kv.mu.Lock()
+		_, ok := kv.memory["swept"]
+		kv.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(wait) {
+			t.Fatal("sweeper didn't remove swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// a deadline in the past expires the key at once:
+	_ = kv.SetWithDeadline("past", 4, clock.Now().Add(-time.Hour))
+	if _, ok, _ := kv.Get("past"); ok {
+		t.Error("past has a deadline that has passed")
+	}
+}
+
+func TestExpirySweep(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now), WithExpirySweep(time.Millisecond))
+	defer kv.Close()
+	_ = kv.SetWithTTL("foo", 1, time.Minute)
+	clock.Advance(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		kv.mu.Lock()
+		_, ok := kv.memory["foo"]
+		kv.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sweeper didn't remove foo")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceKeepsTTL(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	_ = kv.SetWithTTL("foo", 1, time.Minute)
+	_ = kv.SetWithTTL("bar", 2, time.Second)
+	_ = kv.Set("baz", 3)
+	clock.Advance(2 * time.Second)
+	// bar has expired, so it's dropped rather than dumped.
+	err := kv.Coalesce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(kv.walName)
+	err = kv.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	kv.mu.Lock()
+	_, barDumped := kv.memory["bar"]
+	deadline, ok := kv.expires["foo"]
+	kv.mu.Unlock()
+	if barDumped {
+		t.Error("expired bar was dumped")
+	}
+	if !ok {
+		t.Fatal("foo lost its deadline")
+	}
+	if want := clock.Now().Add(time.Minute - 2*time.Second); !deadline.Equal(want) {
+		t.Errorf("foo expires at %v, want %v", deadline, want)
+	}
+	if _, ok, _ := kv.Get("baz"); !ok {
+		t.Error("baz is missing")
+	}
+	if _, ok, _ := kv.Get("foo"); !ok {
+		t.Fatal("foo expired too early")
+	}
+	clock.Advance(time.Minute)
+	if _, ok, _ := kv.Get("foo"); ok {
+		t.Error("foo should have expired")
+	}
+}
+
+func TestExportShards(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	for i := 0; i < 100; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	bufs := make([]bytes.Buffer, 4)
+	err := kv.ExportShards(len(bufs), func(shard int) io.Writer {
+		return &bufs[shard]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := make(kvMap)
+	for i := range bufs {
+		shard, err := readDump(&bufs[i], nil)
+		if err != nil {
+			t.Fatalf("shard %d: %v", i, err)
+		}
+		if len(shard) == 0 {
+			t.Errorf("shard %d is empty", i)
+		}
+		for key, value := range shard {
+			all[key] = value
+		}
+	}
+	if !reflect.DeepEqual(all, kv.memory) {
+		t.Error("shards don't add up to the store")
+	}
+}
+
+func TestExportShardsExpiry(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	_ = kv.SetWithTTL("gone", 1, time.Minute)
+	_ = kv.SetWithTTL("kept", 2, time.Hour)
+	clock.Advance(time.Minute)
+	var buf bytes.Buffer
+	err := kv.ExportShards(1, func(int) io.Writer { return &buf })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := make(map[string]time.Time)
+	err = readDumpFunc(&buf, nil, func(int, []byte) {}, func(key string, _ any, deadline time.Time) error {
+		expires[key] = deadline
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Time{"kept": kv.expires["kept"]}
+	if !reflect.DeepEqual(expires, want) {
+		t.Errorf("exported deadlines %v, want %v", expires, want)
+	}
+}
+
+// spyFile wraps the journal file and counts the calls to Sync and Write.
+type spyFile struct {
+	*os.File
+	syncs  atomic.Int32
+	writes atomic.Int32
+}
+
+func (s *spyFile) Sync() error {
+	s.syncs.Add(1)
+	return s.File.Sync()
+}
+
+func (s *spyFile) Write(p []byte) (int, error) {
+	s.writes.Add(1)
+	return s.File.Write(p)
+}
+
+func TestSync(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	spy := &spyFile{File: kv.journal.fh.(*os.File)}
+	kv.journal.fh = spy
+	_ = kv.Set("foo", 1)
+	err := kv.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := spy.syncs.Load(); n != 0 {
+		t.Errorf("Flush synced the file %d times", n)
+	}
+	err = kv.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := spy.syncs.Load(); n != 1 {
+		t.Errorf("Sync synced the file %d times, want 1", n)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("gone", 1)
+	var b Batch
+	b.Set("foo", 1)
+	b.Set("bar", 2)
+	b.Delete("gone")
+	b.Delete("bar")
+	err := kv.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := kv.Get("foo"); val != 1 {
+		t.Errorf("foo is %v, want 1", val)
+	}
+	for _, key := range []string{"gone", "bar"} {
+		if _, ok, _ := kv.Get(key); ok {
+			t.Errorf("%s should be deleted", key)
+		}
+	}
+	// the batch is flushed to the file:
+	ops := journalOps(t, kv.walName)
+	if !reflect.DeepEqual(ops, []Op{OpSet, OpSet, OpSet, OpUnset, OpUnset}) {
+		t.Errorf("journal has ops %v", ops)
+	}
+}
+
+func TestWriteEmptyBatch(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	before, _ := kv.WALSize()
+	err := kv.Write(&Batch{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := kv.WALSize()
+	if before != after {
+		t.Errorf("empty batch changed the WAL size from %d to %d", before, after)
+	}
+}
+
+func TestBackgroundPanic(t *testing.T) {
+	var panicking atomic.Bool
+	clock := func() time.Time {
+		if panicking.Load() {
+			panic("clock exploded")
+		}
+		return time.Now()
+	}
+	kv := newTestKV(t, WithClock(clock), WithExpirySweep(time.Millisecond))
+	defer kv.Close()
+	_ = kv.SetWithTTL("foo", 1, time.Hour)
+	panicking.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for kv.BackgroundErr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("panic in the sweeper wasn't surfaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(kv.BackgroundErr(), ErrBackgroundPanic) {
+		t.Errorf("got %v, want ErrBackgroundPanic", kv.BackgroundErr())
+	}
+	// the store is still usable, the lock was released by the panic:
+	panicking.Store(false)
+	err := kv.Set("bar", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceEveryNOps(t *testing.T) {
+	kv := newTestKV(t, WithCoalesceEveryNOps(10))
+	defer kv.Close()
+	header, err := encodeHeader(kv.journalCfg, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		size, _ := kv.WALSize()
+		if size == int64(len(header)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("WAL wasn't truncated, it is %d bytes", size)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dumped, _, _, err := loadFromGob(kv.fileName, kv.dumpCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumped) != 10 {
+		t.Errorf("dump has %d keys, want 10", len(dumped))
+	}
+}
+
+func TestSwap(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	old, existed, err := kv.Swap("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existed || old != nil {
+		t.Errorf("first swap returned %v, %v", old, existed)
+	}
+	old, existed, err = kv.Swap("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existed || old != 1 {
+		t.Errorf("second swap returned %v, %v, want 1, true", old, existed)
+	}
+	val, _, _ := kv.Get("foo")
+	if val != 2 {
+		t.Errorf("foo is %v, want 2", val)
+	}
+}
+
+func TestApproxMemBytes(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	empty, err := kv.ApproxMemBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), strings.Repeat("x", 1000))
+	}
+	full, err := kv.ApproxMemBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full <= empty {
+		t.Errorf("estimate didn't grow: %d -> %d", empty, full)
+	}
+	// 100 values of 1000 bytes is 100k of data:
+	if full < 100_000 || full > 1_000_000 {
+		t.Errorf("estimate of %d bytes is off for 100k of data", full)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	var kv *KV
+	var evicted []string
+	kv = newTestKV(t, WithMaxKeys(1, PolicyEvictLRU), WithOnEvict(func(key string, value any) {
+		evicted = append(evicted, fmt.Sprintf("%s=%v", key, value))
+		// calling back into the store must not deadlock:
+		_, _, _ = kv.Get(key)
+	}))
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	_ = kv.Set("bar", 2)
+	if !reflect.DeepEqual(evicted, []string{"foo=1"}) {
+		t.Errorf("evicted %v, want [foo=1]", evicted)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	clock := newFakeClock()
+	var kv *KV
+	var expired []string
+	kv = newTestKV(t, WithClock(clock.Now), WithOnExpire(func(key string, value any) {
+		expired = append(expired, fmt.Sprintf("%s=%v", key, value))
+		_ = kv.Set("expired-"+key, true)
+	}))
+	defer kv.Close()
+	_ = kv.SetWithTTL("foo", 1, time.Second)
+	clock.Advance(time.Second)
+	_, _, _ = kv.Get("foo")
+	if !reflect.DeepEqual(expired, []string{"foo=1"}) {
+		t.Errorf("expired %v, want [foo=1]", expired)
+	}
+	if _, ok, _ := kv.Get("expired-foo"); !ok {
+		t.Error("callback couldn't write to the store")
+	}
+}
+
+// failingWriter fails every write, like a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestFailOnWALError(t *testing.T) {
+	kv := newTestKV(t, WithFailOnWALError())
+	defer kv.Close()
+	err := kv.Set("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Degraded(); err != nil {
+		t.Fatalf("healthy store reports degraded: %v", err)
+	}
+	kv.journal.bufWriter = bufio.NewWriterSize(failingWriter{}, 16)
+	err = kv.Set("bar", 2)
+	if !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Set on failing journal: got %v, want ErrDegraded", err)
+	}
+	if _, ok, _ := kv.Get("bar"); ok {
+		t.Error("failed Set changed the memory")
+	}
+	if kv.Degraded() == nil {
+		t.Error("store doesn't report degraded")
+	}
+	// the error is sticky, even if the journal recovers:
+	kv.journal.bufWriter = bufio.NewWriter(io.Discard)
+	if err := kv.Set("baz", 3); !errors.Is(err, ErrDegraded) {
+		t.Errorf("Set on degraded store: got %v, want ErrDegraded", err)
+	}
+	if _, err := kv.Unset("foo"); !errors.Is(err, ErrDegraded) {
+		t.Errorf("Unset on degraded store: got %v, want ErrDegraded", err)
+	}
+	if v, ok, _ := kv.Get("foo"); !ok || v != 1 {
+		t.Errorf("foo = %v, %v after failed Unset", v, ok)
+	}
+}
+
+// recordingHandler keeps every slog record it's given.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+// attrs returns the attributes of the first record with the given op.
+func (h *recordingHandler) attrs(op string) map[string]slog.Value {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		if attrs["op"].String() == op {
+			return attrs
+		}
+	}
+	return nil
+}
+
+func TestSlog(t *testing.T) {
+	h := &recordingHandler{}
+	kv := newTestKV(t, WithSlog(slog.New(h)))
+	_ = kv.Set("foo", "bar")
+	if err := kv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if a := h.attrs("create"); a == nil || a["file"].String() != kv.walName {
+		t.Errorf("journal creation attributes: %v", a)
+	}
+	flush := h.attrs("flush")
+	if flush == nil || flush["bytes"].Int64() == 0 {
+		t.Errorf("flush attributes: %v", flush)
+	}
+	for _, op := range []string{"flush", "coalesce", "close"} {
+		a := h.attrs(op)
+		if a == nil {
+			t.Errorf("no %s record", op)
+			continue
+		}
+		if a["duration"].Kind() != slog.KindDuration {
+			t.Errorf("%s duration is %v", op, a["duration"])
+		}
+	}
+}
+
+func TestNilTracerAndLogger(t *testing.T) {
+	kv := newTestKV(t, WithTracer(nil), WithSlog(nil))
+	defer kv.Close()
+	if err := kv.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncJitter(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithSyncInterval(time.Second), WithSyncJitter(0.2), WithClock(clock.Now))
+	defer kv.Close()
+	rng := rand.New(rand.NewSource(clock.Now().UnixNano()))
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := kv.syncDelay(rng)
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("delay %v is outside 1s ±20%%", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("only %d different delays out of 100", len(seen))
+	}
+	// without jitter the interval is kept as is:
+	plain := newTestKV(t, WithSyncInterval(time.Second))
+	defer plain.Close()
+	if d := plain.syncDelay(rng); d != time.Second {
+		t.Errorf("delay without jitter is %v", d)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	kv := newTestKV(t)
+	a, b := kv.Bucket("a"), kv.Bucket("b")
+	_ = a.Set("foo", 1)
+	_ = b.Set("foo", 2)
+	_ = b.Set("bar", 3)
+	_ = kv.Set("foo", 4)
+	if v, _, _ := a.Get("foo"); v != 1 {
+		t.Errorf("a/foo = %v, want 1", v)
+	}
+	if v, _, _ := b.Get("foo"); v != 2 {
+		t.Errorf("b/foo = %v, want 2", v)
+	}
+	if keys, _ := a.Keys(); !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("a keys = %v, want [foo]", keys)
+	}
+	if keys, _ := b.Keys(); !reflect.DeepEqual(keys, []string{"bar", "foo"}) {
+		t.Errorf("b keys = %v, want [bar foo]", keys)
+	}
+	_, _ = a.Unset("foo")
+	if v, _, _ := b.Get("foo"); v != 2 {
+		t.Errorf("unsetting a/foo changed b/foo to %v", v)
+	}
+	// the buckets survive a reopen:
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if _, ok, _ := a.Get("foo"); ok {
+		t.Error("a/foo is back after reopening")
+	}
+	if v, _, _ := b.Get("bar"); v != 3 {
+		t.Errorf("b/bar = %v after reopening, want 3", v)
+	}
+}
+
+func TestAtomicUpdate(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("version", 1)
+	_ = kv.Set("owner", "alice")
+	_ = kv.Set("lock", true)
+	ok, err := kv.AtomicUpdate(
+		map[string]any{"version": 1, "owner": "alice"},
+		map[string]any{"version": 2, "owner": "bob"},
+		[]string{"lock"})
+	if err != nil || !ok {
+		t.Fatalf("AtomicUpdate with passing conditions: %v, %v", ok, err)
+	}
+	for key, want := range map[string]any{"version": 2, "owner": "bob"} {
+		if v, _, _ := kv.Get(key); v != want {
+			t.Errorf("%s = %v, want %v", key, v, want)
+		}
+	}
+	if _, ok, _ := kv.Get("lock"); ok {
+		t.Error("lock wasn't deleted")
+	}
+	// one stale condition and nothing changes:
+	ok, err = kv.AtomicUpdate(
+		map[string]any{"version": 1, "owner": "bob"},
+		map[string]any{"version": 3, "owner": "carol"},
+		[]string{"owner"})
+	if err != nil || ok {
+		t.Fatalf("AtomicUpdate with a failing condition: %v, %v", ok, err)
+	}
+	for key, want := range map[string]any{"version": 2, "owner": "bob"} {
+		if v, _, _ := kv.Get(key); v != want {
+			t.Errorf("%s = %v after failed update, want %v", key, v, want)
+		}
+	}
+	// a missing key fails the condition:
+	ok, _ = kv.AtomicUpdate(map[string]any{"missing": nil}, map[string]any{"x": 1}, nil)
+	if ok {
+		t.Error("condition on a missing key passed")
+	}
+}
+
+func TestReplayProgress(t *testing.T) {
+	kv := newTestKV(t)
+	for i := 0; i < 2500; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), i)
+	}
+	_ = kv.Close()
+	fi, err := os.Stat(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []int
+	var read []int64
+	reopened, err := New(kv.fileName, kv.walName, WithReplayProgress(func(n int, b int64) {
+		records = append(records, n)
+		read = append(read, b)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if !reflect.DeepEqual(records, []int{1000, 2000, 2500}) {
+		t.Errorf("progress records %v, want [1000 2000 2500]", records)
+	}
+	for i := 1; i < len(read); i++ {
+		if read[i] <= read[i-1] {
+			t.Errorf("bytes read went from %d to %d", read[i-1], read[i])
+		}
+	}
+	if last := read[len(read)-1]; last != fi.Size() {
+		t.Errorf("read %d bytes at the end, journal is %d", last, fi.Size())
+	}
+}
+
+func TestReplayDeadline(t *testing.T) {
+	kv := newTestKV(t)
+	for i := 0; i < 2500; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), i)
+	}
+	_ = kv.Close()
+	// the progress callback slows the replay down past the deadline.
+	slow := WithReplayProgress(func(int, int64) { time.Sleep(50 * time.Millisecond) })
+	_, err := New(kv.fileName, kv.walName, slow, WithReplayDeadline(10*time.Millisecond))
+	if !errors.Is(err, ErrReplayTimeout) {
+		t.Fatalf("slow replay: got %v, want ErrReplayTimeout", err)
+	}
+	// nothing was committed, the journal is still there to be replayed.
+	reopened, err := New(kv.fileName, kv.walName, WithReplayDeadline(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	memory, err := reopened.copyMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memory) != 2500 {
+		t.Errorf("got %d keys after replay, want 2500", len(memory))
+	}
+}
+
+func TestMissingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing", "deeper")
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	_, err := New(db, wal)
+	if !errors.Is(err, ErrMissingDir) {
+		t.Fatalf("New in a missing directory: got %v, want ErrMissingDir", err)
+	}
+	if !strings.Contains(err.Error(), dir) {
+		t.Errorf("error %q doesn't name the directory", err)
+	}
+	kv, err := New(db, wal, WithCreateDirs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if err := kv.Set("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wal); err != nil {
+		t.Errorf("journal wasn't created: %v", err)
+	}
+}
+
+func TestIter(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	want := make(map[string]any)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want[key] = i
+		_ = kv.Set(key, i)
+	}
+	got := make(map[string]any)
+	for key, value := range kv.Iter() {
+		got[key] = value
+		// writing during the iteration doesn't deadlock or show up:
+		_ = kv.Set("new-"+key, value)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("iterated over %v, want %v", got, want)
+	}
+	n := 0
+	for range kv.Iter() {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("iterated %d times, want 3", n)
+	}
+	kv.mu.Lock()
+	readers := kv.readers
+	kv.mu.Unlock()
+	if readers != 0 {
+		t.Errorf("%d readers left after breaking out of the iteration", readers)
+	}
+}
+
+func TestIterSkipsExpired(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	_ = kv.Set("kept", 1)
+	_ = kv.SetWithTTL("gone", 2, time.Minute)
+	clock.Advance(time.Minute)
+	got := make(map[string]any)
+	for key, value := range kv.Iter() {
+		got[key] = value
+	}
+	if want := map[string]any{"kept": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("iterated over %v, want %v", got, want)
+	}
+}
+
+func TestStreamWAL(t *testing.T) {
+	primary := newTestKV(t)
+	defer primary.Close()
+	follower := newTestKV(t)
+	defer follower.Close()
+	_ = primary.Set("before", 1)
+	_ = primary.Set("gone", 2)
+	_ = follower.Set("stale", 3)
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- follower.FollowWAL(pr) }()
+	stop, err := primary.StreamWAL(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = primary.Set("after", 4)
+	_, _ = primary.Unset("gone")
+	_ = primary.SetWithTTL("ttl", 5, time.Hour)
+
+	want := map[string]any{"before": 1, "after": 4, "ttl": 5}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := follower.copyMemory()
+		if reflect.DeepEqual(map[string]any(got), want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower has %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	follower.mu.Lock()
+	_, hasTTL := follower.expires["ttl"]
+	follower.mu.Unlock()
+	if !hasTTL {
+		t.Error("the deadline wasn't streamed")
+	}
+	stop()
+	_ = pw.Close()
+	if err := <-done; err != nil {
+		t.Errorf("FollowWAL: %v", err)
+	}
+	// the follower journaled what it got:
+	_ = follower.Close()
+	if err := follower.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := follower.Get("after"); v != 4 {
+		t.Errorf("after = %v on the reopened follower, want 4", v)
+	}
+}
+
+func TestCompareAndSwapSlice(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("list", []int{1, 2, 3})
+	ok, err := kv.CompareAndSwap("list", []int{1, 2}, []int{4})
+	if err != nil || ok {
+		t.Fatalf("swap with a different slice: %v, %v", ok, err)
+	}
+	ok, err = kv.CompareAndSwap("list", []int{1, 2, 3}, []int{4})
+	if err != nil || !ok {
+		t.Fatalf("swap with an equal slice: %v, %v", ok, err)
+	}
+	if v, _, _ := kv.Get("list"); !reflect.DeepEqual(v, []int{4}) {
+		t.Errorf("list = %v, want [4]", v)
+	}
+	ok, _ = kv.CompareAndSwap("list", map[string]int{"a": 1}, 1)
+	if ok {
+		t.Error("a map compared equal to a slice")
+	}
+}
+
+func TestEqualityFunc(t *testing.T) {
+	// compare strings case-insensitively:
+	kv := newTestKV(t, WithEqualityFunc(func(a, b any) bool {
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		return aok && bok && strings.EqualFold(as, bs)
+	}))
+	defer kv.Close()
+	_ = kv.Set("name", "Alice")
+	ok, err := kv.CompareAndSwap("name", "ALICE", "Bob")
+	if err != nil || !ok {
+		t.Fatalf("swap with the custom equality: %v, %v", ok, err)
+	}
+}
+
+func TestReadWAL(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	_ = kv.Set("foo", 1)
+	_ = kv.SetWithTTL("bar", "baz", time.Minute)
+	_, _ = kv.Unset("foo")
+	_ = kv.Close()
+	fh, err := os.Open(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	records, err := ReadWAL(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{
+		{Op: OpSet, Key: "foo", Value: 1},
+		{Op: OpSet, Key: "bar", Value: "baz", Expires: clock.Now().Add(time.Minute)},
+		{Op: OpUnset, Key: "foo"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("read %d records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		w := want[i]
+		if r.Op != w.Op || r.Key != w.Key || r.Value != w.Value || !r.Expires.Equal(w.Expires) {
+			t.Errorf("record %d = %+v, want %+v", i, r, w)
+		}
+	}
+	// a truncated journal gives the records before the damage:
+	data, _ := os.ReadFile(kv.walName)
+	records, err = ReadWAL(bytes.NewReader(data[:len(data)-3]))
+	if err == nil || len(records) != 2 {
+		t.Errorf("truncated journal: %d records, %v", len(records), err)
+	}
+}
+
+// corruptWAL writes five records, k0 to k4, and lets corrupt damage the
+// bytes of the third one.
+func corruptWAL(t *testing.T, corrupt func(record []byte)) (string, string) {
+	t.Helper()
+	kv := newTestKV(t)
+	for i := 0; i < 5; i++ {
+		_ = kv.Set(fmt.Sprintf("k%d", i), i)
+	}
+	_ = kv.Close()
+	data, err := os.ReadFile(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	jh, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := len(data) - r.Buffered()
+	hsize := jh.recordHeaderSize()
+	for i := 0; i < 2; i++ {
+		_, _, buflen, _, _ := jDecodeSum(data[off:off+hsize], jh.Checksum)
+		off += hsize + int(buflen)
+	}
+	_, _, buflen, _, _ := jDecodeSum(data[off:off+hsize], jh.Checksum)
+	corrupt(data[off : off+hsize+int(buflen)])
+	err = os.WriteFile(kv.walName, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv.fileName, kv.walName
+}
+
+func TestCorruptionPolicy(t *testing.T) {
+	flipPayload := func(record []byte) { record[len(record)-1] ^= 0xff }
+	bogusLength := func(record []byte) { binary.BigEndian.PutUint32(record[1:5], 1<<20) }
+	tests := []struct {
+		name    string
+		policy  CorruptionPolicy
+		corrupt func([]byte)
+		want    []string
+	}{
+		{"skip", PolicySkipRecord, flipPayload, []string{"k0", "k1", "k3", "k4"}},
+		{"skip bogus length", PolicySkipRecord, bogusLength, []string{"k0", "k1", "k3", "k4"}},
+		{"truncate", PolicyTruncate, flipPayload, []string{"k0", "k1"}},
+		{"truncate bogus length", PolicyTruncate, bogusLength, []string{"k0", "k1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, wal := corruptWAL(t, tt.corrupt)
+			kv, err := New(db, wal, WithCorruptionPolicy(tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kv.Close()
+			tx, _ := kv.ReadTx()
+			defer tx.Close()
+			keys, _ := tx.Keys()
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("keys %v, want %v", keys, tt.want)
+			}
+		})
+	}
+	t.Run("abort", func(t *testing.T) {
+		db, wal := corruptWAL(t, flipPayload)
+		_, err := New(db, wal)
+		if !errors.Is(err, ErrJournalCorrupt) {
+			t.Errorf("got %v, want ErrJournalCorrupt", err)
+		}
+	})
+}
+
+func TestOpenAndCreate(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+	_, err := Open(db, wal)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Open of a missing store: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(db); err == nil {
+		t.Error("failed Open created the dump")
+	}
+	kv, err := Create(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("foo", 1)
+	_ = kv.Close()
+	_, err = Create(db, wal)
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Create over an existing store: got %v, want os.ErrExist", err)
+	}
+	kv, err = Open(db, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if v, _, _ := kv.Get("foo"); v != 1 {
+		t.Errorf("foo = %v after Create and Open, want 1", v)
+	}
+}
+
+func TestCoalesceSkipsCleanStore(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	if kv.IsDirty() {
+		t.Error("a new store is dirty")
+	}
+	_ = kv.Set("foo", 1)
+	if !kv.IsDirty() {
+		t.Error("store isn't dirty after Set")
+	}
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	if kv.IsDirty() {
+		t.Error("store is dirty after Coalesce")
+	}
+	// backdate the dump, so a rewrite would show up in the modification time:
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(kv.fileName, past, past); err != nil {
+		t.Fatal(err)
+	}
+	fh := kv.journal.fh
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(kv.fileName); !fi.ModTime().Equal(past) {
+		t.Error("the dump was rewritten by a no-op Coalesce")
+	}
+	if kv.journal.fh != fh {
+		t.Error("the journal was recreated by a no-op Coalesce")
+	}
+	_ = kv.Set("bar", 2)
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(kv.fileName); fi.ModTime().Equal(past) {
+		t.Error("the dump wasn't written by Coalesce after a change")
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	kv := newTestKV(t, WithWriteThrough())
+	defer kv.Close()
+	if kv.durability != DurabilitySync {
+		t.Errorf("durability is %v, want sync", kv.durability)
+	}
+	if err := kv.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash: copy the files as they are on disk, without
+	// flushing or closing, and open the copy.
+	dir := t.TempDir()
+	for _, name := range []string{kv.fileName, kv.walName} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, filepath.Base(name)), data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashed, err := New(filepath.Join(dir, filepath.Base(kv.fileName)), filepath.Join(dir, filepath.Base(kv.walName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashed.Close()
+	if v, _, _ := crashed.Get("foo"); v != "bar" {
+		t.Errorf("foo = %v after the crash, want bar", v)
+	}
+	// a write that can't reach the disk fails:
+	kv.journal.bufWriter = bufio.NewWriterSize(failingWriter{}, 16)
+	if err := kv.Set("baz", 1); err == nil {
+		t.Error("write-through Set succeeded on a failing journal")
+	}
+}
+
+func TestSpillThreshold(t *testing.T) {
+	kv := newTestKV(t, WithSpillThreshold(1024))
+	big := bytes.Repeat([]byte("blob"), 10_000)
+	_ = kv.Set("big", big)
+	_ = kv.Set("small", "value")
+	kv.mu.Lock()
+	_, spilled := kv.memory["big"].(spillRef)
+	_, inline := kv.memory["small"].(string)
+	kv.mu.Unlock()
+	if !spilled {
+		t.Errorf("big value is kept in memory as %T", kv.memory["big"])
+	}
+	if !inline {
+		t.Error("small value was spilled")
+	}
+	if v, _, _ := kv.Get("big"); !bytes.Equal(v.([]byte), big) {
+		t.Error("big value didn't come back from the spill file")
+	}
+	spillName := kv.spillFile.fh.Name()
+	// through the journal:
+	_ = kv.Close()
+	if _, err := os.Stat(spillName); !os.IsNotExist(err) {
+		t.Errorf("spill file is left behind after Close: %v", err)
+	}
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := kv.Get("big"); !bytes.Equal(v.([]byte), big) {
+		t.Error("big value didn't survive a reopen")
+	}
+	kv.mu.Lock()
+	_, spilled = kv.memory["big"].(spillRef)
+	kv.mu.Unlock()
+	if !spilled {
+		t.Error("big value wasn't spilled when loading the store")
+	}
+	// and through the dump:
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Close()
+	plain, err := New(kv.fileName, kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if v, _, _ := plain.Get("big"); !bytes.Equal(v.([]byte), big) {
+		t.Error("big value didn't make it into the dump")
+	}
+}
+
+func TestSpillReclaim(t *testing.T) {
+	kv := newTestKV(t, WithSpillThreshold(1024), WithReadCache(2))
+	defer kv.Close()
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 64<<10) }
+	_ = kv.Set("kept", value(255))
+	_ = kv.Set("big", value(0))
+	tx, err := kv.ReadTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+	_, _, _ = kv.Get("kept")
+	for i := 1; i <= 100; i++ {
+		_ = kv.Set("big", value(i))
+	}
+	fi, err := os.Stat(kv.spillFile.fh.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > minSpillReclaim+64<<10 {
+		t.Errorf("spill file grew to %d bytes for two live values", fi.Size())
+	}
+	files, _ := filepath.Glob(kv.fileName + ".spill-*")
+	if len(files) != 1 {
+		t.Errorf("spill files left behind: %v", files)
+	}
+	if v, _, _ := kv.Get("big"); !bytes.Equal(v.([]byte), value(100)) {
+		t.Error("big has the wrong value after reclaiming")
+	}
+	if v, _, _ := kv.Get("kept"); !bytes.Equal(v.([]byte), value(255)) {
+		t.Error("kept has the wrong value after reclaiming")
+	}
+	// the read transaction still reads from the file it started with:
+	if v, _, err := tx.Get("big"); err != nil || !bytes.Equal(v.([]byte), value(0)) {
+		t.Errorf("read transaction lost its value: %v", err)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	kv := newTestKV(t, WithSpillThreshold(64), WithReadCache(1))
+	defer kv.Close()
+	first := bytes.Repeat([]byte("a"), 1000)
+	second := bytes.Repeat([]byte("b"), 1000)
+	_ = kv.Set("big", first)
+	if v, _, _ := kv.Get("big"); !bytes.Equal(v.([]byte), first) {
+		t.Fatal("got the wrong value")
+	}
+	if _, ok := kv.readCache.elems["big"]; !ok {
+		t.Fatal("the value wasn't cached")
+	}
+	// the write must not leave the first value behind in the cache:
+	_ = kv.Set("big", second)
+	if v, _, _ := kv.Get("big"); !bytes.Equal(v.([]byte), second) {
+		t.Error("got the cached value after a write")
+	}
+	_, _ = kv.Unset("big")
+	if _, ok, _ := kv.Get("big"); ok {
+		t.Error("got the cached value after an unset")
+	}
+	// the cache holds one value:
+	_ = kv.Set("x", first)
+	_ = kv.Set("y", second)
+	_, _, _ = kv.Get("x")
+	_, _, _ = kv.Get("y")
+	if len(kv.readCache.elems) != 1 {
+		t.Errorf("the cache holds %d values, want 1", len(kv.readCache.elems))
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	kv := newTestKV(t, WithWriteRateLimit(100))
+	defer kv.Close()
+	// the first 100 are the burst, the next 50 take half a second.
+	start := time.Now()
+	for i := 0; i < 150; i++ {
+		if err := kv.Set(fmt.Sprintf("key%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("150 writes at 100/s took %v, want about 500ms", elapsed)
+	}
+}
+
+func TestWriteRateLimitReject(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithWriteRateLimit(10), WithRateLimitReject(), WithClock(clock.Now))
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		if err := kv.Set("foo", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.Set("foo", 10); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("write over the limit: got %v, want ErrRateLimited", err)
+	}
+	if _, err := kv.Unset("foo"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("unset over the limit: got %v, want ErrRateLimited", err)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if err := kv.Set("foo", 11); err != nil {
+		t.Errorf("write after the bucket refilled: %v", err)
+	}
+}
+
+func TestMergeAndImportRateLimited(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithWriteRateLimit(10), WithRateLimitReject(), WithClock(clock.Now))
+	defer kv.Close()
+	other := newTestKV(t)
+	defer other.Close()
+	data := make(map[string]any)
+	for i := 0; i < 20; i++ {
+		_ = other.Set(fmt.Sprintf("key-%d", i), i)
+		data[fmt.Sprintf("key-%d", i)] = i
+	}
+	if err := kv.Merge(other, ConflictOverwrite); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Merge: got %v, want ErrRateLimited", err)
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "import.json")
+	err = os.WriteFile(path, buf, 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.ImportJSON(path, ImportMerge); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("ImportJSON: got %v, want ErrRateLimited", err)
+	}
+	if n, _ := kv.CountPrefix(""); n != 0 {
+		t.Errorf("%d keys written over the limit", n)
+	}
+}
+
+func TestWALHighWater(t *testing.T) {
+	kv := newTestKV(t, WithWALHighWater(4096))
+	defer kv.Close()
+	// hold up the background coalesce until we say so:
+	release := make(chan struct{})
+	kv.coalesce = func() error {
+		<-release
+		return kv.Coalesce()
+	}
+	var written atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_ = kv.Set(fmt.Sprintf("key%d", i), strings.Repeat("x", 100))
+			written.Add(1)
+		}
+	}()
+	// the writer gets stuck at the high-water mark:
+	var stuck int32
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n := written.Load()
+		if n == stuck && n > 0 {
+			break
+		}
+		stuck = n
+	}
+	if stuck == 0 || stuck == 1000 {
+		t.Fatalf("writer wasn't held up, wrote %d", stuck)
+	}
+	size, _ := kv.WALSize()
+	if size > 4096+1024 {
+		t.Errorf("journal grew to %d bytes, past the high-water mark", size)
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after the journal was coalesced")
+	}
+	if n := written.Load(); n != 1000 {
+		t.Errorf("wrote %d, want 1000", n)
+	}
+}
+
+func TestWALHighWaterSmall(t *testing.T) {
+	dir := t.TempDir()
+	_, err := New(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal"), WithWALHighWater(150))
+	if err == nil {
+		t.Fatal("a high-water mark below the journal header was accepted")
+	}
+	kv := newTestKV(t, WithWALHighWater(minWALHighWater))
+	defer kv.Close()
+	// a coalesce that finds nothing to do leaves the journal as it is:
+	kv.coalesce = func() error { return nil }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = kv.Set(fmt.Sprintf("key%d", i), strings.Repeat("x", 100))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after a coalesce that didn't shrink the journal")
+	}
+}
+
+func TestWALHighWaterCoalesceFails(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := New(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal"), WithWALHighWater(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	// the dump can't be written while its temporary file is a directory:
+	err = os.Mkdir(filepath.Join(dir, "test.db.tmp"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			err := kv.Set(fmt.Sprintf("key%d", i), strings.Repeat("x", 100))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("writes past the high-water mark succeeded without a coalesce")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after the coalesce failed")
+	}
+	// once the dump can be written, the writes go through again:
+	err = os.Remove(filepath.Join(dir, "test.db.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Set("after", 1)
+	if err != nil {
+		t.Errorf("write after the dump was fixed: %v", err)
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("int", 42)
+	_ = kv.Set("string", "foo")
+	_ = kv.Set("bool", true)
+	_ = kv.Set("bytes", []byte("bar"))
+
+	if v, ok, err := kv.GetInt("int"); v != 42 || !ok || err != nil {
+		t.Errorf("GetInt = %v, %v, %v", v, ok, err)
+	}
+	if v, ok, err := kv.GetString("string"); v != "foo" || !ok || err != nil {
+		t.Errorf("GetString = %v, %v, %v", v, ok, err)
+	}
+	if v, ok, err := kv.GetBool("bool"); !v || !ok || err != nil {
+		t.Errorf("GetBool = %v, %v, %v", v, ok, err)
+	}
+	if v, ok, err := kv.GetBytes("bytes"); string(v) != "bar" || !ok || err != nil {
+		t.Errorf("GetBytes = %v, %v, %v", v, ok, err)
+	}
+	// misses:
+	if _, ok, err := kv.GetInt("missing"); ok || err != nil {
+		t.Errorf("GetInt of a missing key = %v, %v", ok, err)
+	}
+	if _, ok, err := kv.GetBytes("missing"); ok || err != nil {
+		t.Errorf("GetBytes of a missing key = %v, %v", ok, err)
+	}
+	// wrong types:
+	_, _, err := kv.GetInt("string")
+	if !errors.Is(err, ErrWrongType) || !strings.Contains(err.Error(), "string") {
+		t.Errorf("GetInt of a string: %v", err)
+	}
+	if _, _, err := kv.GetString("int"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("GetString of an int: %v", err)
+	}
+	if _, _, err := kv.GetBool("bytes"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("GetBool of bytes: %v", err)
+	}
+	if _, _, err := kv.GetBytes("bool"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("GetBytes of a bool: %v", err)
+	}
+}
+
+type regProbeFoo struct{ N int }
+
+func TestUnregisteredTypeInDump(t *testing.T) {
+	gob.Register(regProbeFoo{})
+	kv := newTestKV(t)
+	_ = kv.Set("foo", regProbeFoo{N: 1})
+	_ = kv.Set("bar", 2)
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Close()
+	// rename the type in the dump to one that isn't registered, as if the
+	// store was opened by a program that never registered it:
+	data, err := os.ReadFile(kv.fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.ReplaceAll(data, []byte("regProbeFoo"), []byte("regProbeBar"))
+	if err := os.WriteFile(kv.fileName, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(kv.fileName, kv.walName)
+	if !errors.Is(err, ErrUnregisteredType) {
+		t.Fatalf("got %v, want ErrUnregisteredType", err)
+	}
+	if !strings.Contains(err.Error(), "regProbeBar") || strings.Contains(err.Error(), "int") {
+		t.Errorf("error %q doesn't name just the missing type", err)
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	for _, key := range []string{"user/1", "user/2", "user/1/posts/1", "user/1/posts/2", "users", "group/1"} {
+		_ = kv.Set(key, true)
+	}
+	_ = kv.SetWithTTL("user/3", true, time.Second)
+	clock.Advance(time.Second)
+	tests := map[string]int{
+		"":               6,
+		"user":           5,
+		"user/":          4,
+		"user/1":         3,
+		"user/1/posts/":  2,
+		"group/":         1,
+		"nothing/":       0,
+		"user/1/posts/1": 1,
+	}
+	for prefix, want := range tests {
+		n, err := kv.CountPrefix(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("CountPrefix(%q) = %d, want %d", prefix, n, want)
+		}
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("old", 1)
+	_ = kv.Set("kept", 2)
+	_ = kv.Coalesce()
+	_ = kv.Set("journaled", 3)
+	tx, _ := kv.ReadTx()
+	err := kv.ReplaceAll(map[string]any{"kept": 20, "new": 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the open transaction still sees the old contents:
+	if v, _, _ := tx.Get("old"); v != 1 {
+		t.Errorf("transaction sees old = %v, want 1", v)
+	}
+	_ = tx.Close()
+	check := func(when string) {
+		t.Helper()
+		got, _ := kv.copyMemory()
+		want := map[string]any{"kept": 20, "new": 30}
+		if !reflect.DeepEqual(map[string]any(got), want) {
+			t.Errorf("%s: store holds %v, want %v", when, got, want)
+		}
+	}
+	check("after ReplaceAll")
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	check("after reopening")
+	if _, err := os.Stat(kv.fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary dump left behind: %v", err)
+	}
+}
+
+func TestCoalesceAsync(t *testing.T) {
+	kv := newTestKV(t)
+	for i := 0; i < 100; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), i)
+	}
+	done := kv.CoalesceAsync()
+	// writes carry on while the dump is written:
+	_ = kv.Set("during", true)
+	_, _ = kv.Unset("key0")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("after", true)
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if _, ok, _ := kv.Get("key0"); ok {
+		t.Error("key0 is back after reopening")
+	}
+	for _, key := range []string{"key1", "key99", "during", "after"} {
+		if _, ok, _ := kv.Get(key); !ok {
+			t.Errorf("%s is missing after reopening", key)
+		}
+	}
+}
+
+func TestCoalesceAsyncInProgress(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("key", 1)
+	// hold the lock, so the first coalesce can't get anywhere.
+	kv.mu.Lock()
+	first := kv.CoalesceAsync()
+	second := kv.CoalesceAsync()
+	if err := <-second; !errors.Is(err, ErrCoalesceInProgress) {
+		t.Errorf("second CoalesceAsync: got %v, want %v", err, ErrCoalesceInProgress)
+	}
+	kv.mu.Unlock()
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if kv.IsDirty() {
+		t.Error("store is dirty after coalescing")
+	}
+	if err := <-kv.CoalesceAsync(); err != nil {
+		t.Errorf("CoalesceAsync after the first finished: %v", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	kv := newTestKV(t)
+	clock := newFakeClock()
+	kv.now = clock.Now
+	_ = kv.Set("before", 1)
+	if err := kv.Checkpoint("release-1"); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("after", 2)
+	_ = kv.Close()
+
+	fh, err := os.Open(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadWAL(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	cp := records[1]
+	if cp.Op != OpCheckpoint || cp.Label != "release-1" || !cp.Time.Equal(clock.Now()) || cp.Key != "" {
+		t.Errorf("unexpected checkpoint record: %+v", cp)
+	}
+
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	got, _ := kv.copyMemory()
+	want := map[string]any{"before": 1, "after": 2}
+	if !reflect.DeepEqual(map[string]any(got), want) {
+		t.Errorf("store holds %v, want %v", got, want)
+	}
+}
+
+func TestWALSequence(t *testing.T) {
+	kv := newTestKV(t)
+	for i := 0; i < 3; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	_ = kv.Coalesce()
+	_ = kv.Set("key-3", 3)
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Seq != 4 {
+		t.Errorf("Stats.Seq is %d, want 4", stats.Seq)
+	}
+	_ = kv.Close()
+	// the numbering carries on over the coalesce and the reopen:
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("key-4", 4)
+	_ = kv.Set("key-5", 5)
+	_ = kv.Close()
+	fh, err := os.Open(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadWAL(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	for i, rec := range records {
+		if want := uint64(5 + i); rec.Seq != want {
+			t.Errorf("record %d has sequence %d, want %d", i, rec.Seq, want)
+		}
+	}
+}
+
+func TestWALSequenceGap(t *testing.T) {
+	wal := filepath.Join(t.TempDir(), "gap.wal")
+	j, err := newJournal(wal, journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for i := 0; i < 3; i++ {
+		n, _ := j.log(OpSet, fmt.Sprintf("key-%d", i), i)
+		sizes = append(sizes, n)
+	}
+	_ = j.close()
+	data, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut out the second record, the checksums of the others still hold:
+	end := len(data) - sizes[2]
+	data = append(data[:end-sizes[1]], data[end:]...)
+	err = os.WriteFile(wal, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	_, err = play(wal, &m, journalConfig{})
+	if !errors.Is(err, ErrJournalCorrupt) {
+		t.Errorf("replaying a journal with a gap: got %v, want %v", err, ErrJournalCorrupt)
+	}
+	// skipping warns about the gap and keeps the records around it:
+	m = make(kvMap)
+	records, err := play(wal, &m, journalConfig{corruption: PolicySkipRecord})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (kvMap{"key-0": 0, "key-2": 2}); records != 2 || !reflect.DeepEqual(m, want) {
+		t.Errorf("replayed %d records into %v, want %v", records, m, want)
+	}
+}
+
+func TestFlushN(t *testing.T) {
+	kv := newTestKV(t, WithDurability(DurabilityFlush), WithSyncInterval(time.Hour))
+	defer kv.Close()
+	_, _ = kv.FlushN() // the journal header
+	var written int
+	for i := 0; i < 3; i++ {
+		kv.mu.Lock()
+		n, err := kv.logOp(OpSet, fmt.Sprintf("key-%d", i), strings.Repeat("x", 100))
+		kv.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += n
+	}
+	n, err := kv.FlushN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != written {
+		t.Errorf("flushed %d bytes, want %d", n, written)
+	}
+	n, _ = kv.FlushN()
+	if n != 0 {
+		t.Errorf("second flush wrote %d bytes, want 0", n)
+	}
+}
+
+func TestRecordCompression(t *testing.T) {
+	big := strings.Repeat("compress me ", 1000)
+	dir := t.TempDir()
+	raw, err := newJournal(filepath.Join(dir, "raw.wal"), journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.close()
+	rawSize, _ := raw.log(OpSet, "big", big)
+	compressed, err := newJournal(filepath.Join(dir, "compressed.wal"),
+		journalConfig{mode: defaultFileMode, codec: CodecFlate, minCompress: 512}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.close()
+	size, _ := compressed.log(OpSet, "big", big)
+	if size >= rawSize {
+		t.Errorf("compressed record is %d bytes, the raw one %d", size, rawSize)
+	}
+	// small records are left alone:
+	rawSmall, _ := raw.log(OpSet, "small", "x")
+	small, _ := compressed.log(OpSet, "small", "x")
+	if small != rawSmall {
+		t.Errorf("small record is %d bytes, want %d", small, rawSmall)
+	}
+
+	kv := newTestKV(t, WithRecordCompression(CodecFlate, 512))
+	_ = kv.Set("big", big)
+	_ = kv.Set("small", "x")
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	got, _ := kv.copyMemory()
+	want := map[string]any{"big": big, "small": "x"}
+	if !reflect.DeepEqual(map[string]any(got), want) {
+		t.Error("values differ after replaying the compressed journal")
+	}
+}
+
+func TestMissingWAL(t *testing.T) {
+	h := &recordingHandler{}
+	kv := newTestKV(t, WithSlog(slog.New(h)))
+	_ = kv.Set("foo", 1)
+	_ = kv.Coalesce()
+	_ = kv.Close()
+	if err := os.Remove(kv.walName); err != nil {
+		t.Fatal(err)
+	}
+	// the strict mode refuses to open:
+	_, err := New(kv.fileName, kv.walName, WithRequireWAL())
+	if !errors.Is(err, ErrMissingWAL) {
+		t.Fatalf("opening without the journal: got %v, want %v", err, ErrMissingWAL)
+	}
+	if _, err := os.Stat(kv.walName); !os.IsNotExist(err) {
+		t.Errorf("the failed open created a journal: %v", err)
+	}
+	// by default it warns and carries on:
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if attrs := h.attrs("open"); attrs == nil || attrs["file"].String() != kv.walName {
+		t.Errorf("no warning about the missing journal, got %v", attrs)
+	}
+	if v, _, _ := kv.Get("foo"); v != 1 {
+		t.Errorf("foo is %v, want 1", v)
+	}
+}
+
+func TestWrongStoreWAL(t *testing.T) {
+	a := newTestKV(t)
+	_ = a.Set("a", 1)
+	_ = a.Close()
+	b := newTestKV(t)
+	_ = b.Set("b", 2)
+	_ = b.Close()
+	// pair a's dump with b's journal:
+	data, err := os.ReadFile(b.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(a.walName, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(a.fileName, a.walName)
+	if !errors.Is(err, ErrWrongStore) {
+		t.Fatalf("opening with another store's journal: got %v, want %v", err, ErrWrongStore)
+	}
+	// b's own files still open fine:
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if v, _, _ := b.Get("b"); v != 2 {
+		t.Errorf("b is %v, want 2", v)
+	}
+}
+
+func TestTypedKVIntKeys(t *testing.T) {
+	kv := newTestKV(t)
+	ids := NewTypedKV[int, string](kv, IntKeys{})
+	for i := 1; i <= 3; i++ {
+		if err := ids.Set(i, fmt.Sprintf("user-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = ids.Unset(2)
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if v, ok, err := ids.Get(3); err != nil || !ok || v != "user-3" {
+		t.Errorf("Get(3) = %q, %v, %v", v, ok, err)
+	}
+	if _, ok, _ := ids.Get(2); ok {
+		t.Error("2 is still there after Unset")
+	}
+	keys, err := ids.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(keys)
+	if !reflect.DeepEqual(keys, []int{1, 3}) {
+		t.Errorf("keys are %v, want [1 3]", keys)
+	}
+}
+
+func TestTypedKVStructKeys(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	kv := newTestKV(t)
+	defer kv.Close()
+	grid := NewTypedKV[point, int](kv, JSONKeys[point]{})
+	_ = grid.Set(point{1, 2}, 12)
+	_ = grid.Set(point{2, 1}, 21)
+	if v, ok, _ := grid.Get(point{2, 1}); !ok || v != 21 {
+		t.Errorf("Get({2 1}) = %v, %v, want 21", v, ok)
+	}
+	keys, err := grid.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d keys, want 2", len(keys))
+	}
+	// a value of another type is reported, not converted:
+	zero, _ := JSONKeys[point]{}.EncodeKey(point{0, 0})
+	_ = kv.Set(zero, "zero")
+	if _, _, err := grid.Get(point{0, 0}); !errors.Is(err, ErrWrongType) {
+		t.Errorf("got %v, want %v", err, ErrWrongType)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	kv := newTestKV(t, WithDurability(DurabilityFlush), WithSyncInterval(time.Hour))
+	defer kv.Close()
+	for i := 0; i < 5; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	_ = kv.Flush()
+	spy := &spyFile{File: kv.journal.fh.(*os.File)}
+	kv.journal.fh = spy
+	kv.journal.bufWriter = bufio.NewWriter(spy)
+	n, err := kv.DeleteMany([]string{"key-0", "missing", "key-2", "key-4", "key-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("removed %d keys, want 3", n)
+	}
+	if w := spy.writes.Load(); w != 1 {
+		t.Errorf("the journal was written %d times, want 1", w)
+	}
+	got, _ := kv.copyMemory()
+	want := map[string]any{"key-1": 1, "key-3": 3}
+	if !reflect.DeepEqual(map[string]any(got), want) {
+		t.Errorf("store holds %v, want %v", got, want)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	kv := newTestKV(t, WithFailOnWALError())
+	_ = kv.Set("foo", 1)
+	_ = kv.Flush()
+	h := kv.Health()
+	if !h.Ready || h.Closed || h.Degraded != nil || h.LastFlush.IsZero() {
+		t.Fatalf("healthy store reports %+v", h)
+	}
+	kv.journal.bufWriter = bufio.NewWriterSize(failingWriter{}, 16)
+	_ = kv.Set("bar", 2)
+	h = kv.Health()
+	if h.Ready || h.Degraded == nil {
+		t.Errorf("store with a failing journal reports %+v", h)
+	}
+	// a failed coalesce is reported too. Truncating the journal doesn't go
+	// through the buffer, so take the file away as well:
+	_ = kv.journal.fh.Close()
+	if err := kv.Coalesce(); err == nil {
+		t.Fatal("coalesce succeeded on a failing journal")
+	}
+	if h = kv.Health(); h.CoalesceErr == nil {
+		t.Error("failed coalesce isn't reported")
+	}
+	_ = kv.Close()
+	if h = kv.Health(); h.Ready || !h.Closed {
+		t.Errorf("closed store reports %+v", h)
+	}
+	// reopening recovers:
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	if h = kv.Health(); !h.Ready || h.Degraded != nil || h.CoalesceErr != nil {
+		t.Errorf("reopened store reports %+v", h)
+	}
+}
+
+func TestCompactIsQuiet(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	before, _ := kv.WALSize()
+	d, err := kv.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d <= 0 {
+		t.Errorf("Compact took %v", d)
+	}
+	after, _ := kv.WALSize()
+	if after >= before {
+		t.Errorf("WAL is %d bytes after Compact, %d before", after, before)
+	}
+	if out.Len() > 0 {
+		t.Errorf("Compact logged %q", out.String())
+	}
+}
+
+func TestAppend(t *testing.T) {
+	kv := newTestKV(t)
+	n, err := kv.Append("list", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("first append: length %d, want 1", n)
+	}
+	first, _, _ := kv.Get("list")
+	n, err = kv.Append("list", "b", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("second append: length %d, want 3", n)
+	}
+	if !reflect.DeepEqual(first, []any{"a"}) {
+		t.Errorf("earlier value changed to %v", first)
+	}
+	_ = kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if v, _, _ := kv.Get("list"); !reflect.DeepEqual(v, []any{"a", "b", 3}) {
+		t.Errorf("list is %v after reopening", v)
+	}
+	_ = kv.Set("number", 1)
+	if _, err := kv.Append("number", 2); !errors.Is(err, ErrWrongType) {
+		t.Errorf("append to an int: got %v, want %v", err, ErrWrongType)
+	}
+	if v, _, _ := kv.Get("number"); v != 1 {
+		t.Errorf("failed append changed the value to %v", v)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("name", "gokvstore")
+	_ = kv.Set("count", 3)
+	_ = kv.Set("tags", []any{"a", "b"})
+	buf, err := json.Marshal(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"name": "gokvstore", "count": 3.0, "tags": []any{"a", "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMarshalJSONExpiry(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	_ = kv.Set("kept", "yes")
+	_ = kv.SetWithTTL("gone", "no", time.Minute)
+	clock.Advance(time.Minute)
+	buf, err := kv.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != `{"kept":"yes"}` {
+		t.Errorf("got %s", buf)
+	}
+}
+
+// TestJournalLogAllocs guards the pooled record buffers. Most of what's
+// left is the gob encoder, which can't be reused between records.
+func TestJournalLogAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are off with the race detector")
+	}
+	j, err := newJournal(filepath.Join(t.TempDir(), "allocs.wal"), journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	value := strings.Repeat("x", 1024)
+	allocs := testing.AllocsPerRun(1000, func() {
+		_, _ = j.log(OpSet, "key", value)
+	})
+	// it was 26 before the buffers were pooled.
+	if allocs > 22 {
+		t.Errorf("logging a record takes %v allocations, want at most 22", allocs)
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	if l := newTestKV(t).Latencies(); l != nil {
+		t.Errorf("latencies tracked without WithLatencyTracking: %v", l)
+	}
+	kv := newTestKV(t, WithLatencyTracking())
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		_ = kv.Set(fmt.Sprintf("key-%d", i), i)
+		_, _, _ = kv.Get(fmt.Sprintf("key-%d", i))
+	}
+	_ = kv.Flush()
+	_ = kv.Coalesce()
+	l := kv.Latencies()
+	for name, want := range map[string]uint64{"set": 10, "get": 10, "coalesce": 1} {
+		h := l[name]
+		if h.Count != want {
+			t.Errorf("%s: %d calls recorded, want %d", name, h.Count, want)
+		}
+		var sum uint64
+		for _, n := range h.Counts {
+			sum += n
+		}
+		if sum != h.Count {
+			t.Errorf("%s: buckets hold %d calls, want %d", name, sum, h.Count)
+		}
+		if len(h.Counts) != len(h.Bounds)+1 {
+			t.Errorf("%s: %d buckets for %d bounds", name, len(h.Counts), len(h.Bounds))
+		}
+		// a Get doesn't touch the disk, it can't take a second:
+		if name == "get" && h.Counts[len(h.Counts)-1] != 0 {
+			t.Errorf("%s: calls slower than a second: %v", name, h.Counts)
+		}
+	}
+	if l["flush"].Count == 0 {
+		t.Error("no flushes recorded")
+	}
+}
+
+func TestReplayWAL(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	kv := newTestKV(t, WithEncryption(key))
+	_ = kv.Set("kept", 1)
+	_ = kv.Set("gone", 2)
+	_, _ = kv.Unset("gone")
+	_ = kv.Set("kept", "updated")
+	_ = kv.Checkpoint("done")
+	_ = kv.Close()
+
+	into := map[string]any{"existing": true, "gone": "from before"}
+	err := ReplayWAL(kv.walName, into, ReplayEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"existing": true, "kept": "updated"}
+	if !reflect.DeepEqual(into, want) {
+		t.Errorf("got %v, want %v", into, want)
+	}
+	if err := ReplayWAL(kv.walName, map[string]any{}); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("replaying without the key: got %v, want %v", err, ErrWrongKey)
+	}
+}
+
+func TestCoalesceHistory(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	for i := 0; i < coalesceHistoryLen+5; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), i)
+		clock.Advance(time.Second)
+		err := kv.Coalesce()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a clean store has nothing to coalesce, so it isn't recorded.
+	_ = kv.Coalesce()
+	history := kv.CoalesceHistory()
+	if len(history) != coalesceHistoryLen {
+		t.Fatalf("got %d events, want %d", len(history), coalesceHistoryLen)
+	}
+	// the oldest five have been pushed out.
+	if want := newFakeClock().Now().Add(6 * time.Second); !history[0].Time.Equal(want) {
+		t.Errorf("oldest event at %v, want %v", history[0].Time, want)
+	}
+	for i, e := range history {
+		if i > 0 && !e.Time.After(history[i-1].Time) {
+			t.Errorf("event %d at %v isn't after %v", i, e.Time, history[i-1].Time)
+		}
+		if e.DumpBytes <= 0 || e.WALReclaimed <= 0 {
+			t.Errorf("event %d: dump %d bytes, reclaimed %d bytes", i, e.DumpBytes, e.WALReclaimed)
+		}
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("lock", "owner-1")
+	ok, err := kv.CompareAndDelete("lock", "owner-2")
+	if err != nil || ok {
+		t.Fatalf("delete with another value: %v, %v", ok, err)
+	}
+	if v, _, _ := kv.Get("lock"); v != "owner-1" {
+		t.Fatalf("lock = %v after a failed delete, want owner-1", v)
+	}
+	ok, err = kv.CompareAndDelete("lock", "owner-1")
+	if err != nil || !ok {
+		t.Fatalf("delete with the current value: %v, %v", ok, err)
+	}
+	ok, err = kv.CompareAndDelete("lock", "owner-1")
+	if err != nil || ok {
+		t.Fatalf("delete of a missing key: %v, %v", ok, err)
+	}
+	// the delete was journaled:
+	_ = kv.Close()
+	err = kv.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if _, ok, _ := kv.Get("lock"); ok {
+		t.Error("lock is back after reopening")
+	}
+}
+
+func TestCoalesceRatio(t *testing.T) {
+	kv := newTestKV(t)
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 256; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), value)
+	}
+	_ = kv.Coalesce()
+	_ = kv.Close()
+	kv.coalesceRatio = 0.5
+	err := kv.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	limit := int64(0.5 * float64(kv.dumpSize))
+	// overwrite the keys until the journal is just under the limit:
+	i := 0
+	for {
+		size, _ := kv.WALSize()
+		if size > limit-2048 {
+			break
+		}
+		_ = kv.Set(fmt.Sprintf("key%d", i%256), value)
+		i++
+	}
+	time.Sleep(10 * time.Millisecond)
+	// the first event is the Coalesce above.
+	if n := len(kv.CoalesceHistory()) - 1; n != 0 {
+		t.Fatalf("coalesced %d times under the ratio", n)
+	}
+	for j := 0; j < 4; j++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i%256), value)
+		i++
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(kv.CoalesceHistory()) == 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the journal went over the ratio without a coalesce")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if e := kv.CoalesceHistory()[1]; e.WALReclaimed < limit {
+		t.Errorf("coalesced a %d byte journal, want over %d", e.WALReclaimed, limit)
+	}
+}
+
+func TestJournalSizeTracked(t *testing.T) {
+	wal := filepath.Join(t.TempDir(), "size.wal")
+	j, err := newJournal(wal, journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	check := func(when string) {
+		t.Helper()
+		if err := j.flush(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.size() != fi.Size() {
+			t.Errorf("%s: size is %d, the file %d bytes", when, j.size(), fi.Size())
+		}
+	}
+	check("created")
+	var mark int64
+	for i := 0; i < 10; i++ {
+		_, _ = j.log(OpSet, fmt.Sprintf("key-%d", i), strings.Repeat("x", i*10))
+		if i == 4 {
+			mark = j.size()
+		}
+	}
+	check("logged")
+	if err := j.dropBefore(mark, 5); err != nil {
+		t.Fatal(err)
+	}
+	check("dropped")
+	if err := j.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	check("truncated")
+}
+
+func TestJournalTruncateInPlace(t *testing.T) {
+	wal := filepath.Join(t.TempDir(), "test.wal")
+	j, err := newJournal(wal, journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _ = j.log(OpSet, fmt.Sprintf("old-%d", i), i)
+	}
+	_ = j.flush()
+	before, _ := os.Stat(wal)
+	_, _ = j.log(OpSet, "buffered", 1)
+	err = j.truncate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(wal)
+	if !os.SameFile(before, after) {
+		t.Error("truncate replaced the journal file")
+	}
+	header, _ := encodeHeader(j.cfg, j.seq)
+	if size := j.size(); size != int64(len(header)) {
+		t.Errorf("truncated journal is %d bytes, want the %d byte header", size, len(header))
+	}
+	_, _ = j.log(OpSet, "new", 2)
+	_, _ = j.log(OpUnset, "new", nil)
+	_, _ = j.log(OpSet, "newer", 3)
+	err = j.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	records, err := playFunc(wal, journalConfig{}, func(op Op, tx Tx) { applyTx(m, op, tx) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 3 || !reflect.DeepEqual(m, kvMap{"newer": 3}) {
+		t.Errorf("replayed %d records into %v, want 3 into map[newer:3]", records, m)
+	}
+}
+
+func TestAuditHook(t *testing.T) {
+	var mu sync.Mutex
+	var trail []string
+	kv := newTestKV(t, WithAuditHook(func(op, key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		trail = append(trail, op+" "+key)
+	}))
+	defer kv.Close()
+	_ = kv.Set("secret", "hunter2")
+	_, _, _ = kv.Get("secret")
+	_, _, _ = kv.Get("missing")
+	_, _ = kv.Unset("secret")
+	want := []string{"set secret", "get secret", "get missing", "unset secret"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(trail, want) {
+		t.Errorf("audit trail %q, want %q", trail, want)
+	}
+}
+
+func TestPage(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	for i := 0; i < 7; i++ {
+		_ = kv.Set(fmt.Sprintf("user/%02d", i), i)
+	}
+	_ = kv.Set("other", true)
+	_ = kv.Set("user", true)
+	var pages [][]string
+	var values []any
+	after := ""
+	for {
+		keys, vals, next, err := kv.Page("user/", after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, keys)
+		values = append(values, vals...)
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	want := [][]string{
+		{"user/00", "user/01", "user/02"},
+		{"user/03", "user/04", "user/05"},
+		{"user/06"},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+	if !reflect.DeepEqual(values, []any{0, 1, 2, 3, 4, 5, 6}) {
+		t.Errorf("got values %v", values)
+	}
+	// a page that ends exactly at the last key has no cursor:
+	_, _, next, _ := kv.Page("user/", "user/03", 3)
+	if next != "" {
+		t.Errorf("got cursor %q after the last page", next)
+	}
+	if _, _, _, err := kv.Page("", "", 0); err == nil {
+		t.Error("a zero limit was accepted")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	kv := newTestKV(t)
+	_, err := New(kv.fileName, kv.walName)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second New on open files: got %v, want ErrLocked", err)
+	}
+	// the failed New mustn't have taken the lock from the open store:
+	if err := kv.Set("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Close()
+	second, err := New(kv.fileName, kv.walName)
+	if err != nil {
+		t.Fatalf("New after Close: %v", err)
+	}
+	if v, _, _ := second.Get("foo"); v != 1 {
+		t.Errorf("foo = %v, want 1", v)
+	}
+	// the first handle can't be reopened while the second has the files:
+	if err := kv.Open(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open of a locked store: got %v, want ErrLocked", err)
+	}
+	_ = second.Close()
+}
+
+// binPoint has no exported fields, so gob can only encode it through
+// MarshalBinary.
+type binPoint struct {
+	x, y int32
+}
+
+func (p binPoint) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32([]byte("BPT:"), uint32(p.x)), uint32(p.y)), nil
+}
+
+func (p *binPoint) UnmarshalBinary(data []byte) error {
+	if len(data) != 12 || !bytes.HasPrefix(data, []byte("BPT:")) {
+		return fmt.Errorf("bad binPoint %x", data)
+	}
+	p.x, p.y = int32(binary.BigEndian.Uint32(data[4:])), int32(binary.BigEndian.Uint32(data[8:]))
+	return nil
+}
+
+func TestBinaryMarshalerValues(t *testing.T) {
+	gob.Register(binPoint{})
+	kv := newTestKV(t)
+	want := binPoint{x: 3, y: -4}
+	err := kv.Set("point", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Set("plain", 1)
+	_ = kv.Flush()
+	wal, err := os.ReadFile(kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, _ := want.MarshalBinary()
+	if !bytes.Contains(wal, custom) {
+		t.Error("the journal doesn't hold the MarshalBinary bytes")
+	}
+	// replayed from the journal, then loaded from the dump:
+	for _, coalesce := range []bool{false, true} {
+		if coalesce {
+			_ = kv.Coalesce()
+		}
+		_ = kv.Close()
+		err = kv.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := kv.Get("point")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("coalesced %v: point = %#v, want %#v", coalesce, got, want)
+		}
+	}
+	_ = kv.Close()
+}
+
+// gateValue blocks in MarshalBinary while gate is set, so a dump that
+// encodes it can be held up halfway.
+type gateValue struct {
+	n int32
+}
+
+var gate struct {
+	sync.Mutex
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (v gateValue) MarshalBinary() ([]byte, error) {
+	gate.Lock()
+	entered, release := gate.entered, gate.release
+	gate.Unlock()
+	if entered != nil {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+	}
+	return binary.BigEndian.AppendUint32(nil, uint32(v.n)), nil
+}
+
+func (v *gateValue) UnmarshalBinary(data []byte) error {
+	v.n = int32(binary.BigEndian.Uint32(data))
+	return nil
+}
+
+func TestCloseWaitsForCoalesce(t *testing.T) {
+	gob.Register(gateValue{})
+	kv := newTestKV(t)
+	for i := 0; i < 100; i++ {
+		_ = kv.Set(fmt.Sprintf("key%d", i), i)
+	}
+	_ = kv.Set("gate", gateValue{n: 7})
+	gate.Lock()
+	gate.entered, gate.release = make(chan struct{}, 1), make(chan struct{})
+	gate.Unlock()
+	defer func() {
+		gate.Lock()
+		gate.entered, gate.release = nil, nil
+		gate.Unlock()
+	}()
+	result := kv.CoalesceAsync()
+	<-gate.entered // the dump is being written
+	closed := make(chan error)
+	go func() { closed <- kv.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while the coalesce was writing the dump")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gate.release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("coalesce cut short by Close: %v", err)
+	}
+	// the coalesce finished, so everything is in the dump:
+	_ = os.Remove(kv.walName)
+	if _, err := os.Stat(kv.fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary dump left behind: %v", err)
+	}
+	err := kv.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	memory, _ := kv.copyMemory()
+	if len(memory) != 101 || memory["gate"] != (gateValue{n: 7}) {
+		t.Errorf("reopened store has %d keys, gate = %v", len(memory), memory["gate"])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	limit, _ := encodedSize(strings.Repeat("x", 100))
+	kv := newTestKV(t, WithMaxValueSize(limit), WithMaxKeys(2, PolicyReject))
+	defer kv.Close()
+	if err := kv.Validate("ok", strings.Repeat("x", 100)); err != nil {
+		t.Errorf("valid value: %v", err)
+	}
+	if err := kv.Validate("big", strings.Repeat("x", 101)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("oversized value: got %v, want ErrValueTooLarge", err)
+	}
+	if err := kv.Validate("func", func() {}); err == nil {
+		t.Error("a func validated, gob can't encode it")
+	}
+	_ = kv.Set("a", 1)
+	_ = kv.Set("b", 2)
+	if err := kv.Validate("c", 3); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("new key in a full store: got %v, want ErrStoreFull", err)
+	}
+	if err := kv.Validate("a", 3); err != nil {
+		t.Errorf("existing key in a full store: %v", err)
+	}
+	// nothing was written:
+	memory, _ := kv.copyMemory()
+	if !reflect.DeepEqual(map[string]any(memory), map[string]any{"a": 1, "b": 2}) {
+		t.Errorf("store holds %v after validating", memory)
+	}
+	if stats, _ := kv.Stats(); stats.Seq != 2 {
+		t.Errorf("journal is at record %d, want 2", stats.Seq)
+	}
+}
+
+// slowSyncFile makes every fsync take at least delay.
+type slowSyncFile struct {
+	*os.File
+	delay time.Duration
+}
+
+func (f *slowSyncFile) Sync() error {
+	time.Sleep(f.delay)
+	return f.File.Sync()
+}
+
+func TestFsyncLatency(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	kv := newTestKV(t, WithLatencyTracking(), WithDurability(DurabilityFlush), WithSyncInterval(time.Hour))
+	defer kv.Close()
+	// the first write is synced right away, get it out of the way:
+	_ = kv.Set("foo", 1)
+	kv.journal.fh = &slowSyncFile{File: kv.journal.fh.(*os.File), delay: delay}
+	_ = kv.Set("bar", 2)
+	err := kv.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := kv.Latencies()
+	if h := l["fsync"]; h.Count != 2 || h.Total < delay {
+		t.Errorf("fsync: %d calls taking %v, want 2 taking at least %v", h.Count, h.Total, delay)
+	}
+	if h := l["flush"]; h.Count == 0 || h.Total >= delay {
+		t.Errorf("flush: %d calls taking %v, the fsync shouldn't count", h.Count, h.Total)
+	}
+	stats, err := kv.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Fsyncs != 2 || stats.FsyncTime < delay {
+		t.Errorf("stats: %d fsyncs taking %v, want 2 taking at least %v", stats.Fsyncs, stats.FsyncTime, delay)
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	src := newTestKV(t)
+	for i := 0; i < 10; i++ {
+		_ = src.Set(fmt.Sprintf("key-%d", i), i)
+	}
+	var snapshot bytes.Buffer
+	err := src.ExportShards(1, func(int) io.Writer { return &snapshot })
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = src.Close()
+	kv, err := OpenSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		v, ok, err := kv.Get(fmt.Sprintf("key-%d", i))
+		if err != nil || !ok || v != i {
+			t.Errorf("key-%d = %v, %v, %v", i, v, ok, err)
+		}
+	}
+	if n, _ := kv.CountPrefix("key-"); n != 10 {
+		t.Errorf("counted %d keys, want 10", n)
+	}
+	if err := kv.Set("key-0", 100); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set: got %v, want ErrReadOnly", err)
+	}
+	if _, err := kv.Unset("key-0"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unset: got %v, want ErrReadOnly", err)
+	}
+	if err := kv.Checkpoint("nope"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Checkpoint: got %v, want ErrReadOnly", err)
+	}
+	if err := kv.Coalesce(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Coalesce: got %v, want ErrReadOnly", err)
+	}
+	if v, _, _ := kv.Get("key-0"); v != 0 {
+		t.Errorf("key-0 = %v after the failed writes, want 0", v)
+	}
+	if err := kv.Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Open(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Open: got %v, want ErrReadOnly", err)
+	}
+}
+
+func TestClosedAndDegradedErrors(t *testing.T) {
+	kv := newTestKV(t, WithFailOnWALError())
+	_ = kv.Set("foo", 1)
+	kv.journal.bufWriter = bufio.NewWriterSize(failingWriter{}, 16)
+	err := kv.Set("bar", strings.Repeat("x", 64))
+	if !errors.Is(err, ErrDegraded) || errors.Is(err, ErrNotReady) {
+		t.Errorf("Set on a degraded store: got %v, want ErrDegraded", err)
+	}
+	// reads are still served from memory:
+	if v, _, err := kv.Get("foo"); err != nil || v != 1 {
+		t.Errorf("Get on a degraded store: %v, %v", v, err)
+	}
+	_ = kv.Close()
+	_, _, err = kv.Get("foo")
+	if !errors.Is(err, ErrClosed) || !errors.Is(err, ErrNotReady) || errors.Is(err, ErrDegraded) {
+		t.Errorf("Get on a closed store: got %v, want ErrClosed", err)
+	}
+	if err := kv.Set("foo", 2); !errors.Is(err, ErrClosed) {
+		t.Errorf("Set on a closed store: got %v, want ErrClosed", err)
+	}
+}
+
+func TestTailWAL(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("a", 1)
+	_ = kv.Flush()
+	records, stop, err := TailWAL(kv.walName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	next := func() Record {
+		t.Helper()
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("no record")
+			return Record{}
+		}
+	}
+	if r := next(); r.Key != "a" {
+		t.Fatalf("got %+v, want a", r)
+	}
+	_ = kv.Set("b", 2)
+	_ = kv.Flush()
+	if r := next(); r.Key != "b" {
+		t.Fatalf("got %+v, want b", r)
+	}
+	// the journal is emptied by the coalesce, the tailer carries on after it:
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = kv.Unset("a")
+	_ = kv.Flush()
+	if r := next(); r.Op != OpUnset || r.Key != "a" {
+		t.Fatalf("got %+v, want unset a", r)
+	}
+	stop()
+	for range records {
+	}
+}
+
+func TestTailWALPartialRecord(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("foo", "bar")
+	_ = kv.Close()
+	data, _ := os.ReadFile(kv.walName)
+	name := filepath.Join(t.TempDir(), "tail.wal")
+	fh, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	// a writer that has only got part of the record out:
+	_, _ = fh.Write(data[:len(data)-3])
+	records, stop, err := TailWAL(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	select {
+	case r := <-records:
+		t.Fatalf("got %+v from a partial record", r)
+	case <-time.After(3 * tailPollInterval):
+	}
+	_, _ = fh.Write(data[len(data)-3:])
+	select {
+	case r := <-records:
+		if r.Key != "foo" || r.Value != "bar" {
+			t.Errorf("got %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the completed record wasn't read")
+	}
+}
+
+func TestKeysDuringWrites(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	defer kv.Close()
+	const n = 100000
+	for i := 0; i < n; i++ {
+		kv.memory[fmt.Sprintf("old-%06d", i)] = i
+	}
+	_ = kv.SetWithTTL("ttl", 1, time.Minute)
+	clock.Advance(time.Hour)
+
+	stop := make(chan struct{})
+	written := make(chan int)
+	go func() {
+		i := 0
+		defer func() { written <- i }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = kv.Set(fmt.Sprintf("new-%06d", i), i)
+			i++
+		}
+	}()
+	keys, err := kv.Keys()
+	close(stop)
+	total := <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Error("keys aren't sorted")
+	}
+	// the new keys are a snapshot of the writes: new-0 up to some point.
+	var news int
+	for _, key := range keys {
+		if key == "ttl" {
+			t.Error("expired key returned")
+		}
+		if strings.HasPrefix(key, "new-") {
+			if key != fmt.Sprintf("new-%06d", news) {
+				t.Fatalf("got %s, want new-%06d", key, news)
+			}
+			news++
+		}
+	}
+	if len(keys)-news != n || news > total {
+		t.Errorf("got %d keys, %d of them new, %d written", len(keys), news, total)
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	dir := t.TempDir()
+	kv := newTestKV(t, WithWALArchive(dir), WithWALArchiveRetention(2, 0))
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	archives, _ := filepath.Glob(filepath.Join(dir, filepath.Base(kv.walName)+".*"))
+	if len(archives) != 1 {
+		t.Fatalf("got archives %v, want 1", archives)
+	}
+	fh, err := os.Open(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	records, err := ReadWAL(fh)
+	if err != nil || len(records) != 1 || records[0].Key != "foo" {
+		t.Errorf("archive holds %+v, %v", records, err)
+	}
+	_ = kv.Flush()
+	live, _ := os.ReadFile(kv.walName)
+	records, err = ReadWAL(bytes.NewReader(live))
+	if err != nil || len(records) != 0 {
+		t.Errorf("live journal holds %+v, %v", records, err)
+	}
+	// only the newest two are kept:
+	for i := 0; i < 2; i++ {
+		_ = kv.Set("bar", i)
+		if err := kv.Coalesce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archives, _ = filepath.Glob(filepath.Join(dir, filepath.Base(kv.walName)+".*"))
+	if len(archives) != 2 {
+		t.Errorf("got archives %v, want 2", archives)
+	}
+	if v, _, _ := kv.Get("foo"); v != 1 {
+		t.Errorf("foo = %v", v)
+	}
+}
+
+func TestRecordHeaderChecksum(t *testing.T) {
+	kv := newTestKV(t)
+	_ = kv.Set("foo", 1)
+	_ = kv.Set("bar", 2)
+	_ = kv.Close()
+	data, _ := os.ReadFile(kv.walName)
+	r := bufio.NewReader(bytes.NewReader(data))
+	jh, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := len(data) - r.Buffered()
+	hsize := jh.recordHeaderSize()
+	_, _, buflen, _, _ := jh.decodeRecordHeader(data[off : off+hsize])
+	off += hsize + int(buflen)
+	// a bit flip in the length of the second record, making it huge:
+	data[off+9] ^= 0x40
+	_, _, _, _, err = jh.decodeRecordHeader(data[off : off+hsize])
+	if !errors.Is(err, ErrJournalCorrupt) {
+		t.Fatalf("decoding the header gave %v, want ErrJournalCorrupt", err)
+	}
+	// the length isn't checked against the size here, so the header
+	// checksum is all that stops the read of the bogus length:
+	records, err := ReadWAL(bytes.NewReader(data))
+	if !errors.Is(err, ErrJournalCorrupt) || !strings.Contains(err.Error(), "header checksum") {
+		t.Errorf("got %v, want a header checksum mismatch", err)
+	}
+	if len(records) != 1 || records[0].Key != "foo" {
+		t.Errorf("got records %+v, want foo", records)
+	}
+}
+
+func TestSetBytes(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	blob := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(blob)
+	if err := kv.SetBytes("blob", blob); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.SetWithTTL("ttl", []byte("short"), time.Hour)
+	_ = kv.Close()
+
+	// the record is the key and the bytes, with no gob encoding:
+	data, _ := os.ReadFile(kv.walName)
+	records, err := ReadWAL(bytes.NewReader(data))
+	if err != nil || len(records) != 2 {
+		t.Fatalf("got %d records, %v", len(records), err)
+	}
+	if !bytes.Equal(records[0].Value.([]byte), blob) || !records[1].Expires.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("records differ: %+v", records[1])
+	}
+	if len(data) > len(blob)+200 {
+		t.Errorf("journal is %d bytes for a %d byte blob", len(data), len(blob))
+	}
+
+	check := func(kv *KV) {
+		t.Helper()
+		got, ok, err := kv.GetBytes("blob")
+		if err != nil || !ok || !bytes.Equal(got, blob) {
+			t.Errorf("blob: %v, %v", ok, err)
+		}
+		if got, _, _ := kv.GetBytes("ttl"); string(got) != "short" {
+			t.Errorf("ttl = %q", got)
+		}
+	}
+	// through the journal:
+	kv, err = New(kv.fileName, kv.walName, WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(kv)
+	kv.mu.Lock()
+	_, hasTTL := kv.expires["ttl"]
+	kv.mu.Unlock()
+	if !hasTTL {
+		t.Error("the deadline wasn't replayed")
+	}
+	// through the dump:
+	if err := kv.Coalesce(); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Close()
+	kv, err = New(kv.fileName, kv.walName, WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	check(kv)
+}
+
+func TestRawBytesHugeKeyLength(t *testing.T) {
+	wal := filepath.Join(t.TempDir(), "huge.wal")
+	j, err := newJournal(wal, journalConfig{mode: defaultFileMode}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a key length of MaxUint64 in a record with valid checksums:
+	payload := append(binary.AppendUvarint(nil, math.MaxUint64), 'x')
+	sum := j.cfg.checksum.sum(payload, j.cfg.seed)
+	_, _ = j.bufWriter.Write(jEncodeSum(OpSet|opRawBytes, j.seq+1, uint32(len(payload)), sum, j.cfg.checksum))
+	_, _ = j.bufWriter.Write(payload)
+	err = j.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(kvMap)
+	_, err = play(wal, &m, journalConfig{})
+	if err == nil {
+		t.Error("replayed a record with a bogus key length")
+	}
+	data, _ := os.ReadFile(wal)
+	_, err = ReadWAL(bytes.NewReader(data))
+	if err == nil {
+		t.Error("read a record with a bogus key length")
+	}
+}
+
+func TestReset(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("foo", 1)
+	_ = kv.SetWithTTL("bar", 2, time.Hour)
+	_ = kv.Coalesce()
+	_ = kv.Set("baz", 3)
+	if err := kv.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := kv.copyMemory(); len(m) != 0 {
+		t.Errorf("store holds %v after reset", m)
+	}
+	if kv.IsDirty() {
+		t.Error("store is dirty after reset")
+	}
+	// still usable, and the reset survives reopening:
+	if err := kv.Set("new", 4); err != nil {
+		t.Fatal(err)
+	}
+	_ = kv.Close()
+	kv, err := New(kv.fileName, kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	m, _ := kv.copyMemory()
+	if !reflect.DeepEqual(map[string]any(m), map[string]any{"new": 4}) {
+		t.Errorf("reopened store holds %v", m)
+	}
+}
+
+func TestSyncWindow(t *testing.T) {
+	kv := newTestKV(t, WithSyncWindow(200*time.Millisecond))
+	defer kv.Close()
+	fsyncs := func() uint64 {
+		st, _ := kv.Stats()
+		return st.Fsyncs
+	}
+	for i := 0; i < 100; i++ {
+		_ = kv.Set(fmt.Sprintf("k%d", i), i)
+	}
+	if n := fsyncs(); n != 0 {
+		t.Errorf("%d fsyncs before the window closed", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fsyncs() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fsyncs(); n != 1 {
+		t.Fatalf("the burst took %d fsyncs, want 1", n)
+	}
+	// the next write opens a new window:
+	_ = kv.Set("late", 1)
+	for fsyncs() == 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := fsyncs(); n != 2 {
+		t.Errorf("got %d fsyncs, want 2", n)
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	kv := newTestKV(t)
+	defer kv.Close()
+	_ = kv.Set("job", "payload")
+	var wg sync.WaitGroup
+	var claimed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, ok, err := kv.GetAndDelete("job")
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				if v != "payload" {
+					t.Errorf("claimed %v", v)
+				}
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := claimed.Load(); n != 1 {
+		t.Errorf("the key was claimed %d times", n)
+	}
+	if _, ok, _ := kv.Get("job"); ok {
+		t.Error("the key is still there")
+	}
+	_ = kv.Close()
+	ops := journalOps(t, kv.walName)
+	if !reflect.DeepEqual(ops, []Op{OpSet, OpUnset}) {
+		t.Errorf("journal has ops %v, want [OpSet OpUnset]", ops)
+	}
+}
+
+func TestChecksumSeed(t *testing.T) {
+	kv := newTestKV(t, WithChecksumSeed(1))
+	_ = kv.Set("foo", 1)
+	_ = kv.Close()
+
+	other, err := New(kv.fileName, kv.walName, WithChecksumSeed(2))
+	if !errors.Is(err, ErrWrongSeed) {
+		t.Errorf("opening with another seed gave %v, want ErrWrongSeed", err)
+	}
+	if err == nil {
+		_ = other.Close()
+	}
+	// the records themselves don't check out under another seed:
+	data, _ := os.ReadFile(kv.walName)
+	r := bufio.NewReader(bytes.NewReader(data))
+	jh, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := len(data) - r.Buffered()
+	hsize := jh.recordHeaderSize()
+	op, _, buflen, checksum, _ := jh.decodeRecordHeader(data[off : off+hsize])
+	op, flags := splitOp(op)
+	buf := data[off+hsize : off+hsize+int(buflen)]
+	if _, err := decodeRecord(op, flags, buf, checksum, jh, journalConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	jh.Seed = 2
+	if _, err := decodeRecord(op, flags, buf, checksum, jh, journalConfig{}); !errors.Is(err, ErrJournalCorrupt) {
+		t.Errorf("decoding under another seed gave %v, want ErrJournalCorrupt", err)
+	}
+
+	if records, err := ReadWAL(bytes.NewReader(data)); err != nil || len(records) != 1 {
+		t.Errorf("ReadWAL: %d records, %v", len(records), err)
+	}
+	kv, err = New(kv.fileName, kv.walName, WithChecksumSeed(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if v, _, _ := kv.Get("foo"); v != 1 {
+		t.Errorf("foo = %v", v)
+	}
+}
+
+func TestRenamePrefix(t *testing.T) {
+	clock := newFakeClock()
+	kv := newTestKV(t, WithClock(clock.Now))
+	_ = kv.Set("old/a", 1)
+	_ = kv.SetWithTTL("old/b", 2, time.Hour)
+	_ = kv.Set("other", 3)
+	n, err := kv.RenamePrefix("old/", "new/")
+	if err != nil || n != 2 {
+		t.Fatalf("moved %d keys, %v", n, err)
+	}
+	want := map[string]any{"new/a": 1, "new/b": 2, "other": 3}
+	if m, _ := kv.copyMemory(); !reflect.DeepEqual(map[string]any(m), want) {
+		t.Errorf("store holds %v, want %v", m, want)
+	}
+	// the move is journaled, deadline and all:
+	_ = kv.Close()
+	kv, err = New(kv.fileName, kv.walName, WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if m, _ := kv.copyMemory(); !reflect.DeepEqual(map[string]any(m), want) {
+		t.Errorf("reopened store holds %v, want %v", m, want)
+	}
+	clock.Advance(time.Hour)
+	if _, ok, _ := kv.Get("new/b"); ok {
+		t.Error("new/b lost its deadline")
+	}
+	// a prefix of the new prefix moves onto keys that are moving themselves:
+	if n, err := kv.RenamePrefix("new/", "new/new/"); err != nil || n != 1 {
+		t.Errorf("moved %d keys, %v", n, err)
+	}
+}
+
+func TestRenamePrefixCollision(t *testing.T) {
+	setup := func() *KV {
+		kv := newTestKV(t)
+		_ = kv.Set("a/x", 1)
+		_ = kv.Set("a/y", 2)
+		_ = kv.Set("b/x", "taken")
+		return kv
+	}
+	kv := setup()
+	defer kv.Close()
+	n, err := kv.RenamePrefix("a/", "b/")
+	if !errors.Is(err, ErrKeyExists) || n != 0 {
+		t.Errorf("moved %d keys, %v, want ErrKeyExists", n, err)
+	}
+	if v, _, _ := kv.Get("a/y"); v != 2 {
+		t.Error("a failed rename moved keys")
+	}
+
+	skip := setup()
+	defer skip.Close()
+	n, err = skip.RenamePrefixWith("a/", "b/", CollisionSkip)
+	want := map[string]any{"a/x": 1, "b/y": 2, "b/x": "taken"}
+	if m, _ := skip.copyMemory(); err != nil || n != 1 || !reflect.DeepEqual(map[string]any(m), want) {
+		t.Errorf("skip: moved %d keys, %v, store holds %v", n, err, m)
+	}
+
+	overwrite := setup()
+	defer overwrite.Close()
+	n, err = overwrite.RenamePrefixWith("a/", "b/", CollisionOverwrite)
+	want = map[string]any{"b/x": 1, "b/y": 2}
+	if m, _ := overwrite.copyMemory(); err != nil || n != 2 || !reflect.DeepEqual(map[string]any(m), want) {
+		t.Errorf("overwrite: moved %d keys, %v, store holds %v", n, err, m)
+	}
+}
+
+func TestAdaptiveBuffer(t *testing.T) {
+	kv := newTestKV(t, WithAdaptiveBuffer())
+	defer kv.Close()
+	st, _ := kv.Stats()
+	if st.WALBuffer != adaptiveMinBuffer {
+		t.Errorf("buffer starts at %d bytes", st.WALBuffer)
+	}
+	big := bytes.Repeat([]byte("x"), 8<<10)
+	for i := 0; i < 2*adaptiveEvery; i++ {
+		_ = kv.Set(fmt.Sprintf("k%d", i), big)
+	}
+	st, _ = kv.Stats()
+	if st.WALBuffer <= 64<<10 || st.WALBuffer > adaptiveMaxBuffer {
+		t.Errorf("buffer is %d bytes after large writes", st.WALBuffer)
+	}
+	// nothing is lost when the buffer is replaced:
+	_ = kv.Close()
+	kv, err := New(kv.fileName, kv.walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if n, _ := kv.CountPrefix("k"); n != 2*adaptiveEvery {
+		t.Errorf("reopened store holds %d keys", n)
+	}
+	// a slow writer gets a small buffer, whatever the record size:
+	if size := bufferTarget(8<<10, 10<<10); size != adaptiveMinBuffer {
+		t.Errorf("slow writer gets %d bytes", size)
+	}
+	if size := bufferTarget(1<<20, 1<<30); size != adaptiveMaxBuffer {
+		t.Errorf("huge records get %d bytes", size)
+	}
+}
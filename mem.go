@@ -0,0 +1,29 @@
+package kv
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// ApproxMemBytes estimates how much memory the data in the store takes up,
+// by gob-encoding the map and counting the bytes. The encoding is thrown
+// away as it is produced. This is only a rough estimate: it is the size of
+// the data on the wire, not the size of the Go values and the map itself.
+func (kv *KV) ApproxMemBytes() (int64, error) {
+	memory, err := kv.copyMemory()
+	if err != nil {
+		return 0, err
+	}
+	// a spilled value only takes up its reference:
+	for key, value := range memory {
+		if ref, ok := value.(spillRef); ok {
+			memory[key] = ref.off
+		}
+	}
+	var cw countingWriter
+	err = gob.NewEncoder(&cw).Encode(memory)
+	if err != nil {
+		return 0, fmt.Errorf("encode: %w", err)
+	}
+	return int64(cw.n), nil
+}
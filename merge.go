@@ -0,0 +1,90 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"unsafe"
+)
+
+// ConflictPolicy decides what Merge does with keys present in both stores.
+type ConflictPolicy uint8
+
+const (
+	// ConflictOverwrite replaces the existing value with the one from the other store.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictKeepExisting keeps the existing value.
+	ConflictKeepExisting
+	// ConflictError aborts the merge, without changes, if any key is present in both stores.
+	ConflictError
+)
+
+var (
+	ErrConflict = errors.New("key exists in both stores")
+)
+
+// Merge copies all the keys from other into kv, resolving keys present in
+// both according to onConflict. Every write is journaled in kv and, like a
+// batch, held up by its write rate limit and WAL high-water mark. The keys
+// keep their deadlines, and keys that have expired in either store are taken
+// to be absent. Both stores are locked for the duration of the merge.
+func (kv *KV) Merge(other *KV, onConflict ConflictPolicy) error {
+	if !kv.ready.Load() || !other.ready.Load() {
+		return ErrClosed
+	}
+	if kv == other {
+		return nil
+	}
+	n, err := other.CountPrefix("")
+	if err != nil || n == 0 {
+		return err
+	}
+	err = kv.beforeWrite(n)
+	if err != nil {
+		return err
+	}
+	// always lock in address order so two concurrent merges in opposite
+	// directions can't deadlock.
+	first, second := kv, other
+	if uintptr(unsafe.Pointer(second)) < uintptr(unsafe.Pointer(first)) {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	err = kv.mergeLocked(other, onConflict)
+	seq := kv.seq
+	second.unlock()
+	first.unlock()
+	if err != nil {
+		return err
+	}
+	return kv.settle(seq, slog.String("op", "merge"), slog.Int("keys", n))
+}
+
+// mergeLocked does the work of Merge. It assumes both stores are locked.
+func (kv *KV) mergeLocked(other *KV, onConflict ConflictPolicy) error {
+	exists := func(key string) bool {
+		_, ok := kv.memory[key]
+		return ok && !kv.expired(key)
+	}
+	if onConflict == ConflictError {
+		for key := range other.memory {
+			if exists(key) && !other.expired(key) {
+				return fmt.Errorf("merge '%s': %w", key, ErrConflict)
+			}
+		}
+	}
+	for key, value := range other.memory {
+		if other.expired(key) {
+			continue
+		}
+		if exists(key) && onConflict == ConflictKeepExisting {
+			continue
+		}
+		err := kv.setExpiringLocked(key, value, other.expires[key])
+		if err != nil {
+			return fmt.Errorf("merge '%s': %w", key, err)
+		}
+	}
+	return nil
+}
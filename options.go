@@ -1,11 +1,18 @@
 package kv
 
-import "time"
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
 
 type KvOption func(*KV)
 
 // WithSyncInterval will set the interval between syncs.
 // If the interval is 0, the sync will be disabled.
+// Unless WithDurability is given, this implies DurabilityFlush.
 func WithSyncInterval(d time.Duration) KvOption {
 	return func(kv *KV) {
 		kv.syncInterval = d
@@ -14,8 +21,381 @@ func WithSyncInterval(d time.Duration) KvOption {
 
 // WithSyncEvery will set the sync to happen after every operation.
 // This will override the sync interval.
+// Unless WithDurability is given, this implies DurabilitySync.
 func WithSyncEvery() KvOption {
 	return func(kv *KV) {
 		kv.syncEvery = true
 	}
 }
+
+// WithTracer will make Set, Flush and Coalesce emit spans on the given tracer.
+// If no tracer is given, or it's nil, a no-op tracer is used.
+func WithTracer(t trace.Tracer) KvOption {
+	return func(kv *KV) {
+		if t == nil {
+			t = noopTracer
+		}
+		kv.tracer = t
+	}
+}
+
+// WithDurability sets the durability level. It takes precedence over
+// WithSyncEvery and WithSyncInterval, though the interval is still used
+// for DurabilityFlush.
+func WithDurability(level Durability) KvOption {
+	return func(kv *KV) {
+		kv.durability = level
+		kv.durabilitySet = true
+	}
+}
+
+// WithChecksum sets the checksum algorithm used for new journal records.
+// The algorithm is stored in the journal header, so an existing journal
+// is always replayed with the algorithm it was written with.
+func WithChecksum(c ChecksumType) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.checksum = c
+	}
+}
+
+// WithEncryption will encrypt the dump and the journal at rest with AES-GCM.
+// The key must be 16, 24 or 32 bytes long. An id derived from the key is
+// stored in the file headers, so opening a store with the wrong key fails
+// with ErrWrongKey. Unencrypted files are still read, and are encrypted
+// the next time they are written.
+func WithEncryption(key []byte) KvOption {
+	return func(kv *KV) {
+		kv.encryptionKey = key
+	}
+}
+
+// WithMaxValueSize will make writes of values larger than size bytes, when
+// gob-encoded, fail with ErrValueTooLarge. The check happens before the
+// store is touched. A size of 0 means no limit.
+func WithMaxValueSize(size int) KvOption {
+	return func(kv *KV) {
+		kv.maxValueSize = size
+	}
+}
+
+// WithMaxKeys limits the store to n keys. Writing a new key to a full store
+// either fails or evicts a key, depending on the policy. Evictions are
+// journaled like any other delete.
+func WithMaxKeys(n int, policy EvictionPolicy) KvOption {
+	return func(kv *KV) {
+		kv.maxKeys = n
+		kv.eviction = policy
+	}
+}
+
+// WithFileMode sets the permissions used when creating the dump and the
+// journal. The umask still applies. The default is 0666.
+func WithFileMode(mode os.FileMode) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.mode = mode
+		kv.dumpCfg.mode = mode
+	}
+}
+
+// WithInitialCapacity sizes the map for n keys when the store is opened,
+// so loading the dump and replaying the journal don't have to grow it as
+// they go. The dump records how many keys it holds and the map is sized
+// for that already, so this pays off when the journal holds most of them.
+func WithInitialCapacity(n int) KvOption {
+	return func(kv *KV) {
+		kv.dumpCfg.capacity = n
+	}
+}
+
+// WithClock replaces time.Now as the source of time for expiry.
+// It's mostly useful for testing.
+func WithClock(now func() time.Time) KvOption {
+	return func(kv *KV) {
+		kv.now = now
+	}
+}
+
+// WithExpirySweep will remove expired keys in the background every interval,
+// rather than waiting for them to be read.
+func WithExpirySweep(interval time.Duration) KvOption {
+	return func(kv *KV) {
+		kv.sweepInterval = interval
+	}
+}
+
+// WithCoalesceEveryNOps will coalesce the journal into the dump in the
+// background once n mutations have been made since the last coalesce.
+func WithCoalesceEveryNOps(n int) KvOption {
+	return func(kv *KV) {
+		kv.coalesceEveryOps = n
+	}
+}
+
+// WithCoalesceRatio will coalesce the journal into the dump in the
+// background once the journal is more than f times the size of the dump,
+// so the journal is allowed to grow with the data set: at 0.5, a 10MB dump
+// is coalesced at a 5MB journal and a 1GB dump at 500MB. Dumps smaller than
+// 64KiB are taken to be 64KiB.
+func WithCoalesceRatio(f float64) KvOption {
+	return func(kv *KV) {
+		kv.coalesceRatio = f
+	}
+}
+
+// WithOnEvict sets a callback that is called with every key evicted by the
+// WithMaxKeys policy, after it has been removed and the removal journaled.
+// The callback runs outside the store's lock, so it can use the store.
+func WithOnEvict(fn func(key string, value any)) KvOption {
+	return func(kv *KV) {
+		kv.onEvict = fn
+	}
+}
+
+// WithOnExpire sets a callback that is called with every key that expires,
+// after it has been removed and the expiry journaled.
+// The callback runs outside the store's lock, so it can use the store.
+func WithOnExpire(fn func(key string, value any)) KvOption {
+	return func(kv *KV) {
+		kv.onExpire = fn
+	}
+}
+
+// WithAuditHook sets a function that is called with the operation, "get",
+// "set" or "unset", and the key on every call to Get, Set and Unset, before
+// the store is touched. The value is never passed, so secrets don't end up
+// in the audit trail. The hook runs outside the store's lock, and must be
+// safe to call from different goroutines.
+func WithAuditHook(fn func(op string, key string)) KvOption {
+	return func(kv *KV) {
+		kv.auditHook = fn
+	}
+}
+
+// WithFailOnWALError makes the store degraded on the first failed journal
+// write. From then on writes fail with ErrDegraded instead of carrying on in
+// memory only, until the store is closed and opened again.
+func WithFailOnWALError() KvOption {
+	return func(kv *KV) {
+		kv.failOnWALError = true
+	}
+}
+
+// WithSlog sends the store's log messages to the logger, with the
+// operation, key, size and duration as attributes. By default, or with a
+// nil logger, nothing is logged.
+func WithSlog(logger *slog.Logger) KvOption {
+	return func(kv *KV) {
+		if logger == nil {
+			logger = discardLogger
+		}
+		kv.logger = logger
+	}
+}
+
+// WithSyncJitter moves every tick of the sync interval by a random amount of
+// up to ±fraction of the interval, so that many stores sharing an interval
+// don't all hit the disk at the same time. fraction is capped to [0, 1].
+func WithSyncJitter(fraction float64) KvOption {
+	return func(kv *KV) {
+		kv.syncJitter = min(max(fraction, 0), 1)
+	}
+}
+
+// WithReplayProgress sets a callback that is called every 1000 records while
+// the journal is replayed on open, and once when the replay is done, with the
+// number of records replayed and the bytes of the journal read so far.
+func WithReplayProgress(fn func(recordsApplied int, bytesRead int64)) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.progress = fn
+	}
+}
+
+// WithCreateDirs creates the directories of the dump and the journal if
+// they don't exist. Without it New fails with ErrMissingDir.
+func WithCreateDirs() KvOption {
+	return func(kv *KV) {
+		kv.createDirs = true
+	}
+}
+
+// WithEqualityFunc sets the function CompareAndSwap and AtomicUpdate use to
+// compare values. The default is reflect.DeepEqual.
+func WithEqualityFunc(fn func(a, b any) bool) KvOption {
+	return func(kv *KV) {
+		kv.equality = fn
+	}
+}
+
+// WithCorruptionPolicy sets what happens when a corrupt record is found
+// while replaying the journal. The default is PolicyAbort.
+func WithCorruptionPolicy(policy CorruptionPolicy) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.corruption = policy
+	}
+}
+
+// WithWriteThrough makes every write wait until it's fsynced to the journal,
+// and fail if it couldn't be, so a write that returns nil survives a crash.
+// It implies DurabilitySync. Without it writes are write-back: failing to
+// get a record to disk is logged, not returned.
+func WithWriteThrough() KvOption {
+	return func(kv *KV) {
+		kv.writeThrough = true
+		kv.durability = DurabilitySync
+		kv.durabilitySet = true
+	}
+}
+
+// WithSpillThreshold keeps values that gob-encode to more than threshold
+// bytes in a spill file next to the dump instead of in memory, reading them
+// back on Get. This caps the memory taken by large values, also while the
+// store is loaded, at the cost of a disk read for every access to them.
+func WithSpillThreshold(threshold int) KvOption {
+	return func(kv *KV) {
+		kv.spillThreshold = threshold
+	}
+}
+
+// WithWriteRateLimit limits the writes to opsPerSec per second on average,
+// allowing bursts of up to a second's worth. Writes over the limit wait
+// for their turn, or fail with ErrRateLimited with WithRateLimitReject.
+// A batch counts as one write per operation in it.
+func WithWriteRateLimit(opsPerSec int) KvOption {
+	return func(kv *KV) {
+		kv.writeRate = opsPerSec
+	}
+}
+
+// WithRateLimitReject makes writes over the WithWriteRateLimit limit fail
+// with ErrRateLimited instead of waiting.
+func WithRateLimitReject() KvOption {
+	return func(kv *KV) {
+		kv.rejectOverRate = true
+	}
+}
+
+// WithRequireWAL makes opening a store fail with ErrMissingWAL if the dump
+// exists but the journal doesn't, instead of logging a warning and
+// starting a new journal. Remove the dump, or open the store without this
+// option, to carry on without the journal.
+func WithRequireWAL() KvOption {
+	return func(kv *KV) {
+		kv.requireWAL = true
+	}
+}
+
+// WithReplayDeadline limits the time opening the store may spend replaying
+// the journal to d. If the replay takes longer, opening fails with
+// ErrReplayTimeout, leaving the store closed and the files untouched.
+func WithReplayDeadline(d time.Duration) KvOption {
+	return func(kv *KV) {
+		kv.replayTimeout = d
+	}
+}
+
+// WithDirSync sets whether the directory is fsynced after a new dump or
+// journal is renamed into place, so a crash right after a Coalesce can't
+// undo the rename. It's on by default, and does nothing on platforms where
+// directories can't be fsynced.
+func WithDirSync(enabled bool) KvOption {
+	return func(kv *KV) {
+		kv.dirSync = enabled
+	}
+}
+
+// WithLatencyTracking records how long Set, Get, Coalesce and Flush take
+// in histograms, see Latencies.
+func WithLatencyTracking() KvOption {
+	return func(kv *KV) {
+		kv.latency = &latencyTracker{}
+	}
+}
+
+// WithRecordCompression compresses the journal records of minSize bytes
+// or more with the codec. Records that don't get smaller are written as
+// they are. The codec is stored in the journal header, so the journal can
+// be replayed whatever the setting when it's opened.
+func WithRecordCompression(codec Codec, minSize int) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.codec = codec
+		kv.journalCfg.minCompress = minSize
+	}
+}
+
+// WithWALHighWater makes writes wait once the journal has grown to bytes,
+// until a coalesce has brought it down to half of that. Reaching the mark
+// starts a coalesce in the background. This bounds the size of the journal
+// at the cost of write latency when the writers outpace the coalescing.
+// New fails if the mark is below 4096 bytes.
+func WithWALHighWater(bytes int64) KvOption {
+	return func(kv *KV) {
+		kv.walHighWater = bytes
+	}
+}
+
+// WithWALArchive keeps the records a coalesce removes from the journal,
+// copying them to a file in dir named after the journal and the time of
+// the coalesce, instead of dropping them. The journal is then replaced by
+// a fresh one rather than emptied in place. See WithWALArchiveRetention
+// for removing old archives, by default they are all kept.
+func WithWALArchive(dir string) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.archiveDir = dir
+	}
+}
+
+// WithWALArchiveRetention removes archived journals, see WithWALArchive,
+// beyond the keep newest ones or older than maxAge, after every coalesce.
+// Zero leaves the count or the age unlimited.
+func WithWALArchiveRetention(keep int, maxAge time.Duration) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.archiveKeep = keep
+		kv.journalCfg.archiveMaxAge = maxAge
+	}
+}
+
+// WithSyncWindow fsyncs the journal d after the first write that isn't on
+// stable storage yet, so a burst of writes within d shares one fsync and a
+// write is never more than d from being durable. Writes don't wait for the
+// fsync. It's a middle ground between WithSyncEvery and WithSyncInterval,
+// and can be combined with the latter. Under DurabilitySync every write is
+// fsynced anyway, and the window isn't used.
+func WithSyncWindow(d time.Duration) KvOption {
+	return func(kv *KV) {
+		kv.syncWindow = d
+	}
+}
+
+// WithReadCache keeps up to size of the values most recently read back
+// from the spill file, see WithSpillThreshold, in memory, so hot keys with
+// large values don't cost a disk read on every Get. A cached value is
+// never returned once the key has been written. Without spilling the
+// values are in memory already and the cache isn't used.
+func WithReadCache(size int) KvOption {
+	return func(kv *KV) {
+		kv.readCacheSize = size
+	}
+}
+
+// WithChecksumSeed starts the checksums of the journal records from seed,
+// and stores the seed in the journal header. Opening a store on a journal
+// written with another seed fails with ErrWrongSeed, and a record copied
+// in from such a journal fails its checksum, so giving every tenant its
+// own seed guards against mixing up their files. Journals written without
+// a seed are still replayed.
+func WithChecksumSeed(seed uint32) KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.seed = seed
+	}
+}
+
+// WithAdaptiveBuffer sizes the journal buffer for the writes as they come,
+// instead of keeping the 4KiB default: every 256 records it's set to fit
+// 32 records of the average size, but no more than 100ms worth of writes
+// at the current rate, so a slow writer doesn't keep records unwritten for
+// long. The buffer stays between 4KiB and 1MiB. Stats reports its size.
+func WithAdaptiveBuffer() KvOption {
+	return func(kv *KV) {
+		kv.journalCfg.adaptive = true
+	}
+}
@@ -0,0 +1,197 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CollisionPolicy decides what RenamePrefixWith does about a key whose new
+// name is taken by a key that isn't moving.
+type CollisionPolicy uint8
+
+const (
+	// CollisionFail makes the rename fail with ErrKeyExists, moving nothing.
+	// This is what RenamePrefix does.
+	CollisionFail CollisionPolicy = iota
+	// CollisionSkip leaves the key where it is, keeping the one in the way.
+	CollisionSkip
+	// CollisionOverwrite moves the key, replacing the one in the way.
+	CollisionOverwrite
+)
+
+var (
+	ErrKeyExists = errors.New("key exists")
+)
+
+// CountPrefix returns the number of keys starting with prefix. It counts
+// under the lock without collecting the keys or the values, going through
+// every key in the store.
+func (kv *KV) CountPrefix(prefix string) (int, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	n := 0
+	for key := range kv.memory {
+		if strings.HasPrefix(key, prefix) && !kv.expired(key) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Page returns up to limit keys starting with prefix and their values, in
+// key order, beginning after the key after. An empty after starts from the
+// first key. nextAfter is the after of the next page, or empty if this is
+// the last one. The keys are sorted on every call, so a page costs a pass
+// over every key in the store.
+func (kv *KV) Page(prefix string, after string, limit int) (keys []string, values []any, nextAfter string, err error) {
+	if limit < 1 {
+		return nil, nil, "", fmt.Errorf("invalid page limit %d", limit)
+	}
+	if !kv.ready.Load() {
+		return nil, nil, "", ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for key := range kv.memory {
+		if strings.HasPrefix(key, prefix) && (after == "" || key > after) && !kv.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+		nextAfter = keys[limit-1]
+	}
+	values = make([]any, len(keys))
+	for i, key := range keys {
+		values[i], err = unspill(kv.memory[key])
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("load '%s': %w", key, err)
+		}
+	}
+	return keys, values, nextAfter, nil
+}
+
+// RenamePrefix moves every key starting with oldPrefix to the same key
+// starting with newPrefix instead, keeping the values and the deadlines,
+// and returns the number of keys moved. It fails with ErrKeyExists, and
+// moves nothing, if a new key is taken by a key that isn't moving, see
+// RenamePrefixWith for the other policies.
+func (kv *KV) RenamePrefix(oldPrefix, newPrefix string) (int, error) {
+	return kv.RenamePrefixWith(oldPrefix, newPrefix, CollisionFail)
+}
+
+// RenamePrefixWith is RenamePrefix with a policy for the new keys that are
+// taken. The keys are moved under one lock, journaling the deletes of the
+// old keys and the writes of the new ones back to back and flushing the
+// journal once, like a Batch.
+func (kv *KV) RenamePrefixWith(oldPrefix, newPrefix string, policy CollisionPolicy) (int, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	if oldPrefix == newPrefix {
+		return 0, nil
+	}
+	n, err := kv.CountPrefix(oldPrefix)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	// every key moved is a delete and a write.
+	err = kv.beforeWrite(2 * n)
+	if err != nil {
+		return 0, err
+	}
+	kv.mu.Lock()
+	moves := make(map[string]string)
+	for key := range kv.memory {
+		if strings.HasPrefix(key, oldPrefix) && !kv.expired(key) {
+			moves[key] = newPrefix + key[len(oldPrefix):]
+		}
+	}
+	// a key in the way that is moving itself is no collision, unless it's
+	// skipped, which can make another key collide in turn:
+	for changed := true; changed; {
+		changed = false
+		for from, to := range moves {
+			if _, moving := moves[to]; moving {
+				continue
+			}
+			if _, ok := kv.memory[to]; !ok || kv.expired(to) {
+				continue
+			}
+			switch policy {
+			case CollisionFail:
+				kv.unlock()
+				return 0, fmt.Errorf("%w: '%s'", ErrKeyExists, to)
+			case CollisionSkip:
+				delete(moves, from)
+				changed = true
+			}
+		}
+	}
+	err = kv.renameLocked(moves)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return 0, err
+	}
+	err = kv.settle(seq, slog.String("op", "rename prefix"), slog.Int("keys", len(moves)))
+	if err != nil {
+		return 0, err
+	}
+	return len(moves), nil
+}
+
+// renameLocked moves the keys from the keys of moves to its values. It
+// assumes kv is locked.
+func (kv *KV) renameLocked(moves map[string]string) error {
+	type moved struct {
+		stored  any
+		value   any
+		expires time.Time
+	}
+	targets := make(map[string]moved, len(moves))
+	for from, to := range moves {
+		value, err := unspill(kv.memory[from])
+		if err != nil {
+			return err
+		}
+		targets[to] = moved{stored: kv.memory[from], value: value, expires: kv.expires[from]}
+	}
+	for from := range moves {
+		if _, ok := targets[from]; ok {
+			// it's overwritten below.
+			continue
+		}
+		err := kv.unsetLocked(from)
+		if err != nil {
+			return fmt.Errorf("rename '%s': %w", from, err)
+		}
+	}
+	for to, m := range targets {
+		_, err := kv.logTx(OpSet, Tx{Key: to, Value: m.value, Expires: m.expires})
+		if err != nil {
+			return fmt.Errorf("rename to '%s': %w", to, err)
+		}
+		kv.mutable()
+		kv.memory[to] = m.stored
+		if m.expires.IsZero() {
+			delete(kv.expires, to)
+		} else {
+			kv.expires[to] = m.expires
+		}
+		kv.touch(to)
+	}
+	if kv.durability != DurabilitySync && kv.durability != DurabilityNone {
+		_, err := kv.flushLocked()
+		return err
+	}
+	return nil
+}
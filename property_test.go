@@ -0,0 +1,135 @@
+package kv
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+type propInner struct {
+	Score float64
+	Flags map[string]bool
+}
+
+type propStruct struct {
+	Name  string
+	Count int
+	Tags  []string
+	Inner propInner
+}
+
+func init() {
+	gob.Register(propStruct{})
+	gob.Register([]int{})
+	gob.Register(map[string]int{})
+}
+
+// propValues is a set of keys with values of assorted types.
+type propValues map[string]any
+
+func randString(r *rand.Rand) string {
+	b := make([]byte, r.Intn(20))
+	for i := range b {
+		b[i] = byte(' ' + r.Intn(95))
+	}
+	return string(b)
+}
+
+// randValue returns a random value. Slices and maps are never empty, as
+// gob doesn't tell an empty one apart from a missing one inside a struct.
+func randValue(r *rand.Rand) any {
+	switch r.Intn(6) {
+	case 0:
+		return r.Int()
+	case 1:
+		return randString(r)
+	case 2:
+		s := make([]int, 1+r.Intn(10))
+		for i := range s {
+			s[i] = r.Intn(1000) - 500
+		}
+		return s
+	case 3:
+		m := make(map[string]int)
+		for i := 0; i <= r.Intn(10); i++ {
+			m[randString(r)] = r.Int()
+		}
+		return m
+	case 4:
+		return r.Float64()
+	default:
+		s := propStruct{
+			Name:  randString(r),
+			Count: r.Int(),
+			Tags:  []string{randString(r)},
+			Inner: propInner{Score: r.Float64(), Flags: map[string]bool{randString(r): r.Intn(2) == 0}},
+		}
+		return s
+	}
+}
+
+func (propValues) Generate(r *rand.Rand, size int) reflect.Value {
+	v := make(propValues)
+	for i := 0; i < size; i++ {
+		v[fmt.Sprintf("key-%d-%s", i, randString(r))] = randValue(r)
+	}
+	return reflect.ValueOf(v)
+}
+
+// TestRoundTripProperty stores random values and checks that they come back
+// the same after reopening the store, both from the journal and from the dump.
+func TestRoundTripProperty(t *testing.T) {
+	roundTrip := func(t *testing.T, values propValues, coalesce bool) bool {
+		dir := t.TempDir()
+		db, wal := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.wal")
+		kv, err := New(db, wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range values {
+			if err := kv.Set(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if coalesce {
+			err = kv.Coalesce()
+		} else {
+			err = kv.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = kv.Close()
+		kv, err = New(db, wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kv.Close()
+		got, err := kv.copyMemory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(map[string]any(got), map[string]any(values)) {
+			t.Logf("got %#v\nwant %#v", got, values)
+			return false
+		}
+		return true
+	}
+	cfg := &quick.Config{MaxCount: 50}
+	t.Run("journal", func(t *testing.T) {
+		err := quick.Check(func(v propValues) bool { return roundTrip(t, v, false) }, cfg)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("dump", func(t *testing.T) {
+		err := quick.Check(func(v propValues) bool { return roundTrip(t, v, true) }, cfg)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
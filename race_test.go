@@ -0,0 +1,7 @@
+//go:build race
+
+package kv
+
+// raceEnabled is set when the race detector is on. It makes sync.Pool drop
+// items at random, which throws off allocation counts.
+const raceEnabled = true
@@ -0,0 +1,63 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("write rate limit exceeded")
+)
+
+// limiter is a token bucket holding up to a second's worth of writes.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	tokens float64
+	last   time.Time
+	reject bool // fail with ErrRateLimited instead of waiting
+}
+
+func newLimiter(opsPerSec int, reject bool, now time.Time) *limiter {
+	return &limiter{rate: float64(opsPerSec), tokens: float64(opsPerSec), last: now, reject: reject}
+}
+
+// take takes n tokens from the bucket. It returns how long the caller must
+// wait for them, or ErrRateLimited if the limiter rejects rather than waits.
+func (l *limiter) take(n int, now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.tokens+elapsed.Seconds()*l.rate, l.rate)
+		l.last = now
+	}
+	if l.tokens >= float64(n) {
+		l.tokens -= float64(n)
+		return 0, nil
+	}
+	if l.reject {
+		return 0, fmt.Errorf("%w: %v writes per second", ErrRateLimited, l.rate)
+	}
+	// take the tokens on credit, the caller waits until they've been made up.
+	missing := float64(n) - l.tokens
+	l.tokens -= float64(n)
+	return time.Duration(missing / l.rate * float64(time.Second)), nil
+}
+
+// throttle holds up a write of n operations according to the write rate limit.
+// It must be called without holding the lock.
+func (kv *KV) throttle(n int) error {
+	if kv.limiter == nil {
+		return nil
+	}
+	wait, err := kv.limiter.take(n, kv.now())
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// opRawBytes is set in the op byte of a record header when the record is
+// an OpSet of a []byte value, encoded by appendBytesTx instead of gob. It
+// saves the gob type information and the encoding work for blobs.
+const opRawBytes Op = 0x40
+
+// recordFlags are the flags that can be set in the op byte of a record header.
+const recordFlags = opCompressed | opRawBytes
+
+// rawBytes returns the value of tx if it can be journaled raw.
+func rawBytes(op Op, tx Tx) ([]byte, bool) {
+	if op != OpSet || tx.Label != "" {
+		return nil, false
+	}
+	b, ok := tx.Value.([]byte)
+	return b, ok
+}
+
+// appendBytesTx appends the raw encoding of an OpSet of b to dst: the
+// length of the key as a uvarint, the key, a byte telling if the key
+// expires, followed by the deadline in Unix nanoseconds if it does, and
+// the bytes.
+func appendBytesTx(dst []byte, key string, expires time.Time, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(key)))
+	dst = append(dst, key...)
+	if expires.IsZero() {
+		dst = append(dst, 0)
+	} else {
+		dst = append(dst, 1)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(expires.UnixNano()))
+	}
+	return append(dst, b...)
+}
+
+// decodeBytesTx decodes a record encoded by appendBytesTx. The value is
+// copied, buf may be reused.
+func decodeBytesTx(buf []byte) (Tx, error) {
+	n, size := binary.Uvarint(buf)
+	// the key must leave room for the expiry byte, compared so a huge
+	// length can't overflow:
+	if size <= 0 || n >= uint64(len(buf)-size) {
+		return Tx{}, fmt.Errorf("decode tx: bad key length")
+	}
+	buf = buf[size:]
+	tx := Tx{Key: string(buf[:n])}
+	buf = buf[n:]
+	if buf[0] != 0 {
+		if len(buf) < 9 {
+			return Tx{}, fmt.Errorf("decode tx: short deadline")
+		}
+		tx.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(buf[1:9])))
+		buf = buf[8:]
+	}
+	tx.Value = bytes.Clone(buf[1:])
+	return tx, nil
+}
@@ -0,0 +1,100 @@
+package kv
+
+import "container/list"
+
+// readCache keeps the values most recently loaded from the spill file, so
+// hot keys aren't read back from disk on every Get. An entry remembers
+// the reference it was loaded from, and is only used while the map still
+// holds that reference: a write to the key stores a new one, so a cached
+// value can't outlive the value it was loaded from.
+type readCache struct {
+	size  int
+	order *list.List // most recently used first
+	elems map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	key   string
+	ref   spillRef
+	value any
+}
+
+func newReadCache(size int) *readCache {
+	return &readCache{size: size, order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// get returns the cached value of key if it was loaded from ref.
+func (c *readCache) get(key string, ref spillRef) (any, bool) {
+	e, ok := c.elems[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(readCacheEntry)
+	if entry.ref != ref {
+		// the key has been written since.
+		c.order.Remove(e)
+		delete(c.elems, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+// put caches the value loaded from ref, dropping the least recently used
+// entry if the cache is full.
+func (c *readCache) put(key string, ref spillRef, value any) {
+	entry := readCacheEntry{key: key, ref: ref, value: value}
+	if e, ok := c.elems[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.elems[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elems, oldest.Value.(readCacheEntry).key)
+	}
+}
+
+// rebase points the cached values at where moved has moved their
+// references to, dropping those that weren't moved.
+func (c *readCache) rebase(moved map[spillRef]spillRef) {
+	for key, e := range c.elems {
+		entry := e.Value.(readCacheEntry)
+		ref, ok := moved[entry.ref]
+		if !ok {
+			c.order.Remove(e)
+			delete(c.elems, key)
+			continue
+		}
+		entry.ref = ref
+		e.Value = entry
+	}
+}
+
+// forget drops the cached value of key.
+func (c *readCache) forget(key string) {
+	if e, ok := c.elems[key]; ok {
+		c.order.Remove(e)
+		delete(c.elems, key)
+	}
+}
+
+// loadCached is unspill for Get, going through the read cache if there is
+// one. It assumes kv is locked.
+func (kv *KV) loadCached(key string, value any) (any, error) {
+	ref, ok := value.(spillRef)
+	if !ok || kv.readCache == nil {
+		return unspill(value)
+	}
+	if v, ok := kv.readCache.get(key, ref); ok {
+		return v, nil
+	}
+	v, err := ref.load()
+	if err != nil {
+		return nil, err
+	}
+	kv.readCache.put(key, ref, v)
+	return v, nil
+}
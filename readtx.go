@@ -0,0 +1,145 @@
+package kv
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrTxClosed = errors.New("read transaction is closed")
+)
+
+// ReadTx is a read-only view of the store, frozen at the time it was created.
+// Writes to the store after that are not visible through it.
+type ReadTx struct {
+	kv      *KV
+	memory  kvMap
+	expires map[string]time.Time // the deadlines when the transaction started
+	gen     uint64
+}
+
+// ReadTx starts a read transaction. Creating it is cheap: the map is shared
+// with the store, and the first write to the store after that copies the
+// map before changing it. Only the deadlines of the keys that expire are
+// copied. Close the transaction when done, so writes don't copy the map
+// needlessly.
+func (kv *KV) ReadTx() (*ReadTx, error) {
+	if !kv.ready.Load() {
+		return nil, ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.readers++
+	expires := make(map[string]time.Time, len(kv.expires))
+	for key, deadline := range kv.expires {
+		expires[key] = deadline
+	}
+	return &ReadTx{kv: kv, memory: kv.memory, expires: expires, gen: kv.gen}, nil
+}
+
+// expired reports whether the key's deadline has passed.
+func (tx *ReadTx) expired(key string) bool {
+	deadline, ok := tx.expires[key]
+	return ok && !tx.kv.now().Before(deadline)
+}
+
+// Get returns the value of the key as it was when the transaction started.
+// A key whose deadline has passed since is missing.
+func (tx *ReadTx) Get(key string) (any, bool, error) {
+	if tx.memory == nil {
+		return nil, false, ErrTxClosed
+	}
+	val, ok := tx.memory[key]
+	if !ok || tx.expired(key) {
+		return nil, false, nil
+	}
+	val, err := unspill(val)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// Has reports whether the key existed when the transaction started.
+func (tx *ReadTx) Has(key string) (bool, error) {
+	_, ok, err := tx.Get(key)
+	return ok, err
+}
+
+// Keys returns the sorted keys as they were when the transaction started,
+// leaving out the expired ones.
+func (tx *ReadTx) Keys() ([]string, error) {
+	if tx.memory == nil {
+		return nil, ErrTxClosed
+	}
+	keys := make([]string, 0, len(tx.memory))
+	for key := range tx.memory {
+		if !tx.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Close ends the transaction. Calling it more than once is harmless.
+func (tx *ReadTx) Close() error {
+	if tx.memory == nil {
+		return nil
+	}
+	tx.memory = nil
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	// if the map has been copied since, the store has already forgotten us.
+	if tx.gen == tx.kv.gen {
+		tx.kv.readers--
+	}
+	return nil
+}
+
+// mutable makes sure kv.memory isn't shared with any open read transaction,
+// copying it if it is. It must be called before changing kv.memory and
+// assumes kv is locked.
+func (kv *KV) mutable() {
+	if kv.readers == 0 {
+		return
+	}
+	m := make(kvMap, len(kv.memory))
+	for key, value := range kv.memory {
+		m[key] = value
+	}
+	kv.memory = m
+	kv.gen++
+	kv.readers = 0
+}
+
+// Keys returns the sorted keys in the store, leaving out expired ones.
+// The store is only locked to share the map like ReadTx does and to note
+// which keys have expired, the keys are gathered and sorted without the
+// lock, so a large store doesn't hold up writers for long.
+func (kv *KV) Keys() ([]string, error) {
+	if !kv.ready.Load() {
+		return nil, ErrClosed
+	}
+	kv.mu.Lock()
+	kv.readers++
+	tx := &ReadTx{kv: kv, memory: kv.memory, gen: kv.gen}
+	now := kv.now()
+	expired := make(map[string]bool)
+	for key, deadline := range kv.expires {
+		if !now.Before(deadline) {
+			expired[key] = true
+		}
+	}
+	kv.mu.Unlock()
+	defer tx.Close()
+	keys := make([]string, 0, len(tx.memory))
+	for key := range tx.memory {
+		if !expired[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,153 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ReplaceAll replaces everything in the store with data, as one durable
+// step: after a crash the store holds either the old contents or data,
+// never a mix. Any changes in the journal are coalesced first, then data
+// is written to a new dump that is renamed over the old one. The keys
+// lose their time to live. The map is copied, data can be reused.
+func (kv *KV) ReplaceAll(data map[string]any) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	if kv.maxKeys > 0 && len(data) > kv.maxKeys {
+		return fmt.Errorf("%w: %d keys", ErrStoreFull, kv.maxKeys)
+	}
+	for key, value := range data {
+		err := kv.checkValue(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	kv.coalesceMu.Lock()
+	defer kv.coalesceMu.Unlock()
+	// Close might have got in while we waited:
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.unlock()
+	// with an empty journal, the rename below is the only change on disk.
+	if kv.dirty {
+		err := kv.coalesceLocked()
+		if err != nil {
+			return err
+		}
+	}
+	memory := make(kvMap, len(data))
+	for key, value := range data {
+		stored, err := kv.spill(value)
+		if err != nil {
+			return err
+		}
+		memory[key] = stored
+	}
+	err := replaceDumpFile(kv.fileName, memory, nil, kv.dumpCfg)
+	if err != nil {
+		return fmt.Errorf("replacing dump: %w", err)
+	}
+	// tell the followers:
+	for key := range kv.memory {
+		if _, ok := data[key]; !ok {
+			kv.publish(OpUnset, Tx{Key: key})
+		}
+	}
+	for key, value := range data {
+		kv.publish(OpSet, Tx{Key: key, Value: value})
+	}
+	// the open read transactions keep the old map.
+	kv.memory = memory
+	kv.readers = 0
+	kv.gen++
+	kv.expires = make(map[string]time.Time)
+	kv.coalesces++
+	kv.statDump()
+	if kv.recency != nil {
+		kv.recency = newLRU(memory)
+	}
+	return nil
+}
+
+// Reset empties the store: the journal is truncated, an empty dump is
+// written and the keys are removed from memory, so one store can be reused
+// between test cases without closing it and deleting its files. It's meant
+// for tests: unlike ReplaceAll it isn't one durable step, a crash halfway
+// can leave the old dump in place. The followers are told about the keys
+// removed.
+func (kv *KV) Reset() error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	kv.coalesceMu.Lock()
+	defer kv.coalesceMu.Unlock()
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.unlock()
+	err := kv.journal.truncate()
+	if err != nil {
+		return fmt.Errorf("truncating journal: %w", err)
+	}
+	err = replaceDumpFile(kv.fileName, nil, nil, kv.dumpCfg)
+	if err != nil {
+		return fmt.Errorf("replacing dump: %w", err)
+	}
+	for key := range kv.memory {
+		kv.publish(OpUnset, Tx{Key: key})
+	}
+	// the open read transactions keep the old map.
+	kv.memory = make(kvMap)
+	kv.readers = 0
+	kv.gen++
+	kv.expires = make(map[string]time.Time)
+	kv.dirty = false
+	kv.opsSinceCoalesce.Store(0)
+	kv.walDrained.Broadcast()
+	kv.statDump()
+	if kv.recency != nil {
+		kv.recency = newLRU(kv.memory)
+	}
+	return nil
+}
+
+// replaceDumpFile writes the map to a new file and renames it over the dump,
+// so the dump is either the old one or the new one, never a partial one.
+func replaceDumpFile(dbName string, m kvMap, expires map[string]time.Time, cfg dumpConfig) error {
+	tmp := dbName + ".tmp"
+	fh, err := createFile(tmp, cfg.mode)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	err = writeDump(fh, m, expires, cfg.crypt, cfg.storeID)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("writing dump: %w", err)
+	}
+	err = fh.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("closing file: %w", err)
+	}
+	err = renameFile(tmp, dbName, cfg.dirSync)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// ExportShards splits the store into n shards by the hash of the key and
+// writes them concurrently, shard i to the writer returned by w(i).
+// Every shard is written in the dump format, so each of them can be used as
+// the dump file of a store of its own. The keys keep their deadlines, and
+// expired keys are left out. The writers must be safe to use from
+// different goroutines.
+func (kv *KV) ExportShards(n int, w func(shard int) io.Writer) error {
+	if n < 1 {
+		return fmt.Errorf("invalid shard count %d", n)
+	}
+	memory, expires, err := kv.copyMemoryExpiring()
+	if err != nil {
+		return err
+	}
+	shards := make([]kvMap, n)
+	for i := range shards {
+		shards[i] = make(kvMap, len(memory)/n)
+	}
+	for key, value := range memory {
+		shards[shardOf(key, n)][key] = value
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := writeDump(w(i), shards[i], expires, kv.dumpCfg.crypt, nil)
+			if err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// shardOf returns the shard the key belongs to.
+func shardOf(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,62 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReadOnly = errors.New("store is read-only")
+)
+
+// OpenSnapshot loads a store from r into memory, read-only, with no files
+// behind it. r holds a dump: a dump file, or a shard written by
+// ExportShards. Reads work as usual, writes fail with ErrReadOnly, and so
+// do Coalesce and Open after Close. Keys with a time to live still expire.
+// Of the options, those about reading apply: WithEncryption for an
+// encrypted dump, WithClock, WithSlog and WithTracer, WithLatencyTracking.
+func OpenSnapshot(r io.Reader, opts ...KvOption) (*KV, error) {
+	kv := &KV{
+		tracer:   noopTracer,
+		logger:   discardLogger,
+		group:    newGroupCommit(),
+		now:      time.Now,
+		readOnly: true,
+	}
+	for _, opt := range opts {
+		opt(kv)
+	}
+	// there's no journal to write to:
+	kv.durability = DurabilityNone
+	kv.walDrained = sync.NewCond(&kv.mu)
+	kv.coalesce = kv.Coalesce
+	if kv.encryptionKey != nil {
+		c, err := newCrypter(kv.encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+		kv.dumpCfg.crypt = c
+	}
+	var memory kvMap
+	expires := make(map[string]time.Time)
+	err := readDumpFunc(r, kv.dumpCfg.crypt, func(n int, _ []byte) {
+		memory = make(kvMap, max(n, kv.dumpCfg.capacity))
+	}, func(key string, value any, deadline time.Time) error {
+		memory[key] = value
+		if !deadline.IsZero() {
+			expires[key] = deadline
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	kv.memory = memory
+	kv.expires = expires
+	kv.bgCtrl = make(chan struct{})
+	kv.ready.Store(true)
+	return kv, nil
+}
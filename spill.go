@@ -0,0 +1,221 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+)
+
+// minSpillReclaim is the size the spill file may reach before the space
+// taken by overwritten and deleted values is first reclaimed.
+const minSpillReclaim = 1 << 20
+
+// spillFile holds the values larger than the spill threshold, so that only
+// a reference to them is kept in memory. It's scratch space: the values are
+// still journaled and dumped as usual, and the file is removed when the
+// store is closed. Values that are overwritten or deleted are left behind
+// in the file until it outgrows its limit, see reclaimSpill.
+type spillFile struct {
+	fh     *os.File
+	dbName string // the dump the file is kept next to
+	size   int64
+	limit  int64    // size at which the live values are moved to a new file
+	crypt  *crypter // the store's encryption, so spilled values aren't left in the clear
+}
+
+// spillRef stands in for a spilled value in the map.
+type spillRef struct {
+	f   *spillFile
+	off int64
+	n   int
+	typ reflect.Type // type of the value
+}
+
+// newSpillFile creates the spill file next to the dump.
+func newSpillFile(dbName string, crypt *crypter) (*spillFile, error) {
+	fh, err := os.CreateTemp(filepath.Dir(dbName), filepath.Base(dbName)+".spill-*")
+	if err != nil {
+		return nil, fmt.Errorf("create spill file: %w", err)
+	}
+	return &spillFile{fh: fh, dbName: dbName, limit: minSpillReclaim, crypt: crypt}, nil
+}
+
+// put writes the value to the end of the spill file.
+// Only one put may run at the time, the caller must hold the store's lock.
+func (f *spillFile) put(value any) (spillRef, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(Tx{Value: value})
+	if err != nil {
+		return spillRef{}, fmt.Errorf("encode spilled value: %w", err)
+	}
+	data := buf.Bytes()
+	if f.crypt != nil {
+		data, err = f.crypt.seal(data, nil)
+		if err != nil {
+			return spillRef{}, err
+		}
+	}
+	return f.write(data, reflect.TypeOf(value))
+}
+
+// write appends the encoded value of type typ to the spill file.
+func (f *spillFile) write(data []byte, typ reflect.Type) (spillRef, error) {
+	_, err := f.fh.WriteAt(data, f.size)
+	if err != nil {
+		return spillRef{}, fmt.Errorf("write spill file: %w", err)
+	}
+	ref := spillRef{f: f, off: f.size, n: len(data), typ: typ}
+	f.size += int64(len(data))
+	return ref, nil
+}
+
+// copyRef copies the value ref points at to the end of the spill file as
+// it is, still encoded and encrypted.
+func (f *spillFile) copyRef(ref spillRef) (spillRef, error) {
+	data := make([]byte, ref.n)
+	_, err := ref.f.fh.ReadAt(data, ref.off)
+	if err != nil {
+		return spillRef{}, fmt.Errorf("read spill file: %w", err)
+	}
+	return f.write(data, ref.typ)
+}
+
+// retire removes a spill file that has been replaced by a new one. Read
+// transactions might still be reading from it, so it's only closed once
+// nothing refers to it anymore. Where an open file can't be removed, it's
+// removed when it's closed.
+func (f *spillFile) retire() {
+	_ = os.Remove(f.fh.Name())
+	runtime.SetFinalizer(f, func(f *spillFile) {
+		_ = f.fh.Close()
+		_ = os.Remove(f.fh.Name())
+	})
+}
+
+// close closes and removes the spill file.
+func (f *spillFile) close() error {
+	err := f.fh.Close()
+	if err != nil {
+		return fmt.Errorf("close spill file: %w", err)
+	}
+	return os.Remove(f.fh.Name())
+}
+
+// load reads the value back from the spill file. It's safe to call without
+// the store's lock, since the part of the file it reads is never rewritten.
+func (r spillRef) load() (any, error) {
+	data := make([]byte, r.n)
+	_, err := r.f.fh.ReadAt(data, r.off)
+	if err != nil {
+		return nil, fmt.Errorf("read spill file: %w", err)
+	}
+	if r.f.crypt != nil {
+		data, err = r.f.crypt.open(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt spilled value: %w", err)
+		}
+	}
+	var tx Tx
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&tx)
+	if err != nil {
+		return nil, fmt.Errorf("decode spilled value: %w", err)
+	}
+	return tx.Value, nil
+}
+
+// MarshalJSON exports the spilled value rather than the reference.
+func (r spillRef) MarshalJSON() ([]byte, error) {
+	value, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// unspill returns the value, loading it from the spill file if it's been
+// spilled. Every value read out of the map on its way to a caller, the
+// dump or the journal must pass through here.
+func unspill(value any) (any, error) {
+	if ref, ok := value.(spillRef); ok {
+		return ref.load()
+	}
+	return value, nil
+}
+
+// reclaimSpill moves the live values to a new spill file once the spill
+// file has outgrown its limit, leaving the space of the overwritten and
+// deleted values behind with the old one. The new limit is twice what was
+// moved, so the copying is paid for by the writes in between. Failing to
+// reclaim is logged, the old file is kept on with a raised limit. It
+// assumes kv is locked.
+func (kv *KV) reclaimSpill() {
+	old := kv.spillFile
+	if old == nil || old.size < old.limit {
+		return
+	}
+	f, moved, err := kv.moveSpilled(old)
+	if err != nil {
+		kv.logger.Error("reclaiming spill file failed", slog.String("op", "spill"), slog.Any("error", err))
+		old.limit = 2 * old.size
+		return
+	}
+	f.limit = max(2*f.size, minSpillReclaim)
+	kv.mutable()
+	for key, value := range kv.memory {
+		if ref, ok := value.(spillRef); ok && ref.f == old {
+			kv.memory[key] = moved[ref]
+		}
+	}
+	if kv.readCache != nil {
+		kv.readCache.rebase(moved)
+	}
+	kv.spillFile = f
+	old.retire()
+}
+
+// moveSpilled copies the values in the map that are spilled to old to a new
+// spill file, returning it and where each value went. It assumes kv is locked.
+func (kv *KV) moveSpilled(old *spillFile) (*spillFile, map[spillRef]spillRef, error) {
+	f, err := newSpillFile(old.dbName, old.crypt)
+	if err != nil {
+		return nil, nil, err
+	}
+	moved := make(map[spillRef]spillRef)
+	for _, value := range kv.memory {
+		ref, ok := value.(spillRef)
+		if !ok || ref.f != old {
+			continue
+		}
+		if _, ok := moved[ref]; ok {
+			continue
+		}
+		moved[ref], err = f.copyRef(ref)
+		if err != nil {
+			_ = f.close()
+			return nil, nil, err
+		}
+	}
+	return f, moved, nil
+}
+
+// spill moves the value to the spill file if it's larger than the spill
+// threshold, returning what to keep in the map. It assumes kv is locked.
+func (kv *KV) spill(value any) (any, error) {
+	if kv.spillFile == nil {
+		return value, nil
+	}
+	size, err := encodedSize(value)
+	if err != nil {
+		return nil, err
+	}
+	if size <= kv.spillThreshold {
+		return value, nil
+	}
+	return kv.spillFile.put(value)
+}
@@ -0,0 +1,36 @@
+package kv
+
+import "time"
+
+// Stats is a snapshot of the store's counters.
+type Stats struct {
+	Keys      int           // keys in memory, including expired ones not yet swept
+	WALBytes  int64         // size of the journal, including what is still buffered
+	Seq       uint64        // sequence number of the last record journaled
+	Fsyncs    uint64        // fsyncs of the journal since the store was created
+	FsyncTime time.Duration // time spent in them, not counting flushing the buffer
+	WALBuffer int           // size of the journal buffer, see WithAdaptiveBuffer
+}
+
+// Stats returns the current counters of the store.
+func (kv *KV) Stats() (Stats, error) {
+	if !kv.ready.Load() {
+		return Stats{}, ErrClosed
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	var size int64
+	var buffer int
+	if !kv.readOnly {
+		size = kv.journal.size()
+		buffer = kv.journal.bufWriter.Size()
+	}
+	return Stats{
+		Keys:      len(kv.memory),
+		WALBytes:  size,
+		Seq:       kv.journal.seq,
+		Fsyncs:    kv.fsyncs,
+		FsyncTime: kv.fsyncTime,
+		WALBuffer: buffer,
+	}, nil
+}
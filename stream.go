@@ -0,0 +1,247 @@
+package kv
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// streamRecord is what StreamWAL sends and FollowWAL receives. The stream
+// starts with the entries in the store as OpSet records, followed by a
+// record with End set, and then carries on with the records as they are
+// journaled.
+type streamRecord struct {
+	Op  Op
+	Tx  Tx
+	End bool // marks the end of the base snapshot
+}
+
+// walStream sends the journaled records to a follower. The records are
+// queued without limit, so a follower that can't keep up costs memory on
+// the primary.
+type walStream struct {
+	mu      sync.Mutex
+	pending []streamRecord
+	stopped bool
+	wake    chan struct{}
+}
+
+// push queues the record for the follower.
+func (s *walStream) push(rec streamRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.pending = append(s.pending, rec)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop makes the stream's goroutine return once the current write is done.
+func (s *walStream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.pending = nil
+	close(s.wake)
+}
+
+// take returns the queued records, waiting for some to arrive.
+// It returns false once the stream is stopped.
+func (s *walStream) take() ([]streamRecord, bool) {
+	for {
+		s.mu.Lock()
+		pending, stopped := s.pending, s.stopped
+		s.pending = nil
+		s.mu.Unlock()
+		if stopped {
+			return nil, false
+		}
+		if len(pending) > 0 {
+			return pending, true
+		}
+		<-s.wake
+	}
+}
+
+// StreamWAL sends the contents of the store to w, followed by every record
+// journaled from then on, as it's written, until stop is called, the store
+// is closed or a write to w fails. Feed w to FollowWAL on the follower.
+// Records are only sent once journaled, so nothing is streamed with
+// DurabilityNone.
+func (kv *KV) StreamWAL(w io.Writer) (stop func(), err error) {
+	if !kv.ready.Load() {
+		return nil, ErrClosed
+	}
+	s := &walStream{wake: make(chan struct{}, 1)}
+	// share the map like a ReadTx, so the snapshot is consistent with the
+	// records queued after it without copying the map.
+	kv.mu.Lock()
+	kv.readers++
+	tx := &ReadTx{kv: kv, memory: kv.memory, gen: kv.gen}
+	expires := make(map[string]time.Time, len(kv.expires))
+	for key, deadline := range kv.expires {
+		expires[key] = deadline
+	}
+	kv.streams = append(kv.streams, s)
+	kv.mu.Unlock()
+
+	go func() {
+		defer kv.dropStream(s)
+		enc := gob.NewEncoder(w)
+		send := func(rec streamRecord) bool {
+			err := enc.Encode(rec)
+			if err != nil {
+				kv.logger.Error("streaming journal failed", slog.String("op", "stream"), slog.Any("error", err))
+				return false
+			}
+			return true
+		}
+		for key, value := range tx.memory {
+			value, err := unspill(value)
+			if err != nil {
+				kv.logger.Error("streaming journal failed", slog.String("op", "stream"), slog.Any("error", err))
+				_ = tx.Close()
+				return
+			}
+			if !send(streamRecord{Op: OpSet, Tx: Tx{Key: key, Value: value, Expires: expires[key]}}) {
+				_ = tx.Close()
+				return
+			}
+		}
+		_ = tx.Close()
+		if !send(streamRecord{End: true}) {
+			return
+		}
+		for {
+			records, ok := s.take()
+			if !ok {
+				return
+			}
+			for _, rec := range records {
+				if !send(rec) {
+					return
+				}
+			}
+		}
+	}()
+	return s.stop, nil
+}
+
+// publish queues the journaled record on every stream. It assumes kv is locked.
+func (kv *KV) publish(op Op, tx Tx) {
+	for _, s := range kv.streams {
+		s.push(streamRecord{Op: op, Tx: tx})
+	}
+}
+
+// dropStream stops the stream and forgets about it.
+func (kv *KV) dropStream(s *walStream) {
+	s.stop()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for i, other := range kv.streams {
+		if other == s {
+			kv.streams = append(kv.streams[:i], kv.streams[i+1:]...)
+			break
+		}
+	}
+}
+
+// FollowWAL applies the stream written by StreamWAL on another store to
+// this one, journaling the records like any other write. Keys that aren't
+// in the primary's snapshot at the start of the stream are removed. It
+// returns nil when the stream ends.
+func (kv *KV) FollowWAL(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	snapshot := make(map[string]bool)
+	for {
+		var rec streamRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decode record: %w", err)
+		}
+		if !kv.ready.Load() {
+			return ErrClosed
+		}
+		kv.mu.Lock()
+		switch {
+		case rec.End:
+			for key := range kv.memory {
+				if !snapshot[key] {
+					err = kv.applyLocked(OpUnset, Tx{Key: key})
+				}
+				if err != nil {
+					break
+				}
+			}
+			snapshot = nil
+		default:
+			if snapshot != nil {
+				snapshot[rec.Tx.Key] = true
+			}
+			err = kv.applyLocked(rec.Op, rec.Tx)
+		}
+		seq := kv.seq
+		kv.unlock()
+		if err != nil {
+			return fmt.Errorf("applying '%s': %w", rec.Tx.Key, err)
+		}
+		err = kv.settle(seq, slog.String("op", "follow"))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyLocked journals the record and applies it to memory, the way it
+// would be applied when replaying the journal. It assumes kv is locked.
+func (kv *KV) applyLocked(op Op, tx Tx) error {
+	stored := tx.Value
+	if op == OpSet {
+		err := kv.checkValue(tx.Key, tx.Value)
+		if err != nil {
+			return err
+		}
+		err = kv.admit(tx.Key)
+		if err != nil {
+			return err
+		}
+		stored, err = kv.spill(tx.Value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := kv.logTx(op, tx)
+	if err != nil {
+		return fmt.Errorf("journaling: %w", err)
+	}
+	kv.mutable()
+	switch op {
+	case OpSet:
+		kv.memory[tx.Key] = stored
+		if tx.Expires.IsZero() {
+			delete(kv.expires, tx.Key)
+		} else {
+			kv.expires[tx.Key] = tx.Expires
+		}
+		kv.touch(tx.Key)
+	case OpUnset, OpExpire:
+		delete(kv.memory, tx.Key)
+		delete(kv.expires, tx.Key)
+		kv.forget(tx.Key)
+	}
+	return nil
+}
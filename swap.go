@@ -0,0 +1,36 @@
+package kv
+
+import "log/slog"
+
+// Swap sets the value and returns the previous one, all under the same lock,
+// so nothing can sneak in between reading the old value and writing the new.
+func (kv *KV) Swap(key string, value any) (old any, existed bool, err error) {
+	if !kv.ready.Load() {
+		return nil, false, ErrClosed
+	}
+	err = kv.beforeWrite(1)
+	if err != nil {
+		return nil, false, err
+	}
+	kv.mu.Lock()
+	old, existed = kv.memory[key]
+	if existed && kv.expired(key) {
+		old, existed = nil, false
+	}
+	old, err = unspill(old)
+	if err != nil {
+		kv.unlock()
+		return nil, false, err
+	}
+	err = kv.setLocked(key, value)
+	seq := kv.seq
+	kv.unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	err = kv.settle(seq, slog.String("op", "swap"), slog.String("key", key))
+	if err != nil {
+		return nil, false, err
+	}
+	return old, existed, nil
+}
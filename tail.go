@@ -0,0 +1,218 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// tailPollInterval is how often TailWAL looks for new records once it has
+// caught up with the journal.
+const tailPollInterval = 50 * time.Millisecond
+
+// TailWAL reads the records of the journal at path, starting at fromOffset,
+// and then follows the journal as records are appended to it, sending them
+// on the returned channel until stop is called. It's meant for another
+// process than the one writing, such as an indexer. An offset within the
+// header starts at the first record, other offsets must be where a record
+// starts. Only flushed records are seen, a record the writer has only
+// written part of is waited for. When the journal is emptied by a coalesce
+// the tailer starts over from its header, skipping the records it has sent
+// already. The channel is closed when stop is called, or if the journal
+// can't be read or is corrupt. Encrypted journals give ErrWrongKey.
+func TailWAL(path string, fromOffset int64) (<-chan Record, func(), error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open journal '%s': %w", path, err)
+	}
+	t := &walTailer{path: path, fh: fh, off: fromOffset, done: make(chan struct{})}
+	// fail early on a journal we'll never be able to read:
+	_, err = t.readHeader()
+	if err != nil {
+		fh.Close()
+		return nil, nil, err
+	}
+	records := make(chan Record, 64)
+	go t.run(records)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(t.done) })
+	}
+	return records, stop, nil
+}
+
+// walTailer follows a journal for TailWAL.
+type walTailer struct {
+	path   string
+	fh     *os.File
+	ready  bool          // the header has been read
+	jh     journalHeader // valid once ready
+	header []byte        // the raw header, to notice a new one; nil for legacy journals
+	off    int64         // offset of the next record
+	last   uint64        // sequence number of the last record sent
+	done   chan struct{}
+}
+
+func (t *walTailer) run(records chan<- Record) {
+	defer close(records)
+	defer func() { t.fh.Close() }()
+	for {
+		if !t.ready {
+			ok, err := t.readHeader()
+			if err != nil {
+				return
+			}
+			if !ok {
+				if !t.wait() {
+					return
+				}
+				continue
+			}
+		}
+		rec, n, ok, err := t.next()
+		if err != nil || !ok {
+			// the journal might have been emptied or replaced under us.
+			if t.replaced() {
+				t.restart()
+				continue
+			}
+			if err != nil || !t.wait() {
+				return
+			}
+			continue
+		}
+		t.off += n
+		// records kept when the journal was cut have been sent already.
+		if rec.Seq != 0 && rec.Seq <= t.last {
+			continue
+		}
+		t.last = rec.Seq
+		select {
+		case records <- rec:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// readHeader reads the journal header, returning false if the writer
+// hasn't got it to the file yet.
+func (t *walTailer) readHeader() (bool, error) {
+	prefix := make([]byte, len(journalMagic)+3)
+	n, err := t.fh.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("read header: %w", err)
+	}
+	if n < len(journalMagic) {
+		return false, nil
+	}
+	var header []byte
+	if string(prefix[:len(journalMagic)]) == journalMagic {
+		if n < len(prefix) {
+			return false, nil
+		}
+		header = make([]byte, len(prefix)+int(binary.BigEndian.Uint16(prefix[len(journalMagic)+1:])))
+		n, err = t.fh.ReadAt(header, 0)
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("read header: %w", err)
+		}
+		if n < len(header) {
+			return false, nil
+		}
+	}
+	// a legacy journal has no header, readHeader gives the default one.
+	jh, err := readHeader(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return false, err
+	}
+	err = journalConfig{}.crypt.check(jh.KeyID)
+	if err != nil {
+		return false, err
+	}
+	t.jh, t.header, t.ready = jh, header, true
+	t.off = max(t.off, int64(len(header)))
+	return true, nil
+}
+
+// next reads the record at t.off, returning its size, or false if it isn't
+// all in the file yet.
+func (t *walTailer) next() (Record, int64, bool, error) {
+	fi, err := t.fh.Stat()
+	if err != nil {
+		return Record{}, 0, false, fmt.Errorf("stat journal: %w", err)
+	}
+	hsize := int64(t.jh.recordHeaderSize())
+	if fi.Size()-t.off < hsize {
+		return Record{}, 0, false, nil
+	}
+	hdr := make([]byte, hsize)
+	_, err = t.fh.ReadAt(hdr, t.off)
+	if err != nil {
+		return Record{}, 0, false, fmt.Errorf("read header: %w", err)
+	}
+	op, seq, length, checksum, err := t.jh.decodeRecordHeader(hdr)
+	if err != nil {
+		return Record{}, 0, false, fmt.Errorf("decode header: %w", err)
+	}
+	op, flags := splitOp(op)
+	if fi.Size()-t.off-hsize < int64(length) {
+		return Record{}, 0, false, nil
+	}
+	buf := make([]byte, length)
+	_, err = t.fh.ReadAt(buf, t.off+hsize)
+	if err != nil {
+		return Record{}, 0, false, fmt.Errorf("read buffer: %w", err)
+	}
+	tx, err := decodeRecord(op, flags, buf, checksum, t.jh, journalConfig{})
+	if err != nil {
+		return Record{}, 0, false, err
+	}
+	rec := Record{Op: op, Key: tx.Key, Value: tx.Value, Expires: tx.Expires, Label: tx.Label, Time: tx.Time, Seq: seq}
+	return rec, hsize + int64(length), true, nil
+}
+
+// replaced reports whether the journal has been emptied or renamed over
+// since the header was read.
+func (t *walTailer) replaced() bool {
+	cur, err := t.fh.Stat()
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(t.path)
+	if err == nil && !os.SameFile(fi, cur) {
+		return true
+	}
+	if cur.Size() < t.off {
+		return true
+	}
+	header := make([]byte, len(t.header))
+	n, _ := t.fh.ReadAt(header, 0)
+	return n < len(header) || !bytes.Equal(header, t.header)
+}
+
+// restart starts over from the header, reopening the journal if it was
+// renamed over.
+func (t *walTailer) restart() {
+	if fh, err := os.Open(t.path); err == nil {
+		t.fh.Close()
+		t.fh = fh
+	}
+	t.ready, t.off = false, 0
+}
+
+// wait waits for the poll interval, returning false if stop was called.
+func (t *walTailer) wait() bool {
+	timer := time.NewTimer(tailPollInterval)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
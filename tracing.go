@@ -0,0 +1,27 @@
+package kv
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/perbu/gokvstore"
+
+// noopTracer is used when no tracer is configured, so spans cost next to nothing.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// noopSpan is what startSpan returns when no tracer is configured.
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// startSpan starts a span for the named operation using the configured
+// tracer. Without one, no span is started and the returned span records
+// nothing, so callers check IsRecording before building its attributes.
+func (kv *KV) startSpan(name string) trace.Span {
+	if kv.tracer == noopTracer {
+		return noopSpan
+	}
+	_, span := kv.tracer.Start(context.Background(), name)
+	return span
+}
@@ -0,0 +1,115 @@
+package kv
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// SetWithTTL sets the value and makes the key expire after ttl. Expired keys
+// are removed when they are next read, by the sweeper if WithExpirySweep
+// is used, or when the store is coalesced. Expiry is journaled as OpExpire.
+// The deadline is kept in the dump, so it survives a coalesce.
+func (kv *KV) SetWithTTL(key string, value any, ttl time.Duration) error {
+	return kv.SetWithDeadline(key, value, kv.now().Add(ttl))
+}
+
+// SetWithDeadline sets the value and makes the key expire at deadline,
+// like SetWithTTL does after the ttl. It saves working out the ttl when
+// many keys share a deadline. A deadline that has passed already makes
+// the key expire at once. The zero time is not a deadline, use Set for
+// keys that don't expire.
+func (kv *KV) SetWithDeadline(key string, value any, deadline time.Time) error {
+	if !kv.ready.Load() {
+		return ErrClosed
+	}
+	if deadline.IsZero() {
+		return fmt.Errorf("set '%s': zero deadline", key)
+	}
+	err := kv.checkValue(key, value)
+	if err != nil {
+		return err
+	}
+	err = kv.beforeWrite(1)
+	if err != nil {
+		return err
+	}
+	kv.mu.Lock()
+	err = kv.admit(key)
+	if err != nil {
+		kv.unlock()
+		return err
+	}
+	stored, err := kv.spill(value)
+	if err != nil {
+		kv.unlock()
+		return err
+	}
+	_, err = kv.logTx(OpSet, Tx{Key: key, Value: value, Expires: deadline})
+	if err != nil {
+		kv.unlock()
+		return fmt.Errorf("journaling: %w", err)
+	}
+	kv.mutable()
+	kv.memory[key] = stored
+	kv.expires[key] = deadline
+	kv.touch(key)
+	seq := kv.seq
+	kv.unlock()
+	err = kv.settle(seq, slog.String("op", "set"), slog.String("key", key))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// expired reports whether the key has a deadline that has passed.
+// It assumes kv is locked.
+func (kv *KV) expired(key string) bool {
+	deadline, ok := kv.expires[key]
+	return ok && !kv.now().Before(deadline)
+}
+
+// expireLocked removes an expired key and journals the expiry.
+// It assumes kv is locked.
+func (kv *KV) expireLocked(key string) error {
+	_, err := kv.logOp(OpExpire, key, nil)
+	if err != nil {
+		return fmt.Errorf("journaling: %w", err)
+	}
+	value := kv.memory[key]
+	kv.mutable()
+	delete(kv.memory, key)
+	delete(kv.expires, key)
+	kv.forget(key)
+	kv.notifyRemoval(key, value, true)
+	return nil
+}
+
+// sweep removes all the expired keys.
+func (kv *KV) sweep() {
+	kv.mu.Lock()
+	defer kv.unlock()
+	for key := range kv.expires {
+		if !kv.expired(key) {
+			continue
+		}
+		err := kv.expireLocked(key)
+		if err != nil {
+			kv.logger.Error("expiring failed", slog.String("op", "expire"), slog.String("key", key), slog.Any("error", err))
+		}
+	}
+}
+
+func (kv *KV) sweeper(ctrl chan struct{}) {
+	ticker := time.NewTicker(kv.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			kv.guard("expiry sweep", kv.sweep)
+		case <-ctrl:
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrWrongType = errors.New("value has the wrong type")
+)
+
+// getAs fetches the value and asserts that it's a T.
+func getAs[T any](kv *KV, key string) (T, bool, error) {
+	var zero T
+	v, ok, err := kv.Get(key)
+	if err != nil || !ok {
+		return zero, ok, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, true, fmt.Errorf("%w: '%s' is %T, not %T", ErrWrongType, key, v, zero)
+	}
+	return t, true, nil
+}
+
+// GetInt returns the value of the key as an int. It fails with ErrWrongType
+// if the value is of any other type.
+func (kv *KV) GetInt(key string) (int, bool, error) {
+	return getAs[int](kv, key)
+}
+
+// GetString returns the value of the key as a string. It fails with
+// ErrWrongType if the value is of any other type.
+func (kv *KV) GetString(key string) (string, bool, error) {
+	return getAs[string](kv, key)
+}
+
+// GetBool returns the value of the key as a bool. It fails with
+// ErrWrongType if the value is of any other type.
+func (kv *KV) GetBool(key string) (bool, bool, error) {
+	return getAs[bool](kv, key)
+}
+
+// GetBytes returns the value of the key as a []byte. It fails with
+// ErrWrongType if the value is of any other type.
+func (kv *KV) GetBytes(key string) ([]byte, bool, error) {
+	return getAs[[]byte](kv, key)
+}
+
+// SetBytes stores b under key. It's Set for blobs: []byte values are
+// journaled as they are instead of gob-encoded, saving the encoding and
+// the type information, whether they are set with Set or SetBytes. The
+// slice is stored, not copied, so it must not be changed afterwards.
+func (kv *KV) SetBytes(key string, b []byte) error {
+	return kv.Set(key, b)
+}
@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnregisteredType = errors.New("type not registered with gob")
+)
+
+// typeProbe records a type of value found in the dump. Sample is a value
+// of the type gob-encoded on its own, so whether the type is registered
+// can be checked by decoding it, before decoding the dump itself fails
+// halfway through with a less helpful error.
+type typeProbe struct {
+	Name   string
+	Sample []byte
+}
+
+// valueType returns the type of the value, looking through spilled values.
+func valueType(value any) reflect.Type {
+	if ref, ok := value.(spillRef); ok {
+		return ref.typ
+	}
+	return reflect.TypeOf(value)
+}
+
+// probeTypes returns a probe for every type of value in the map, sorted by name.
+func probeTypes(m kvMap) ([]typeProbe, error) {
+	seen := make(map[reflect.Type]bool)
+	var probes []typeProbe
+	for _, value := range m {
+		t := valueType(value)
+		if t == nil || seen[t] {
+			continue
+		}
+		seen[t] = true
+		// gob can't encode a nil pointer, so point at a zero value.
+		sample := reflect.Zero(t)
+		if t.Kind() == reflect.Pointer {
+			sample = reflect.New(t.Elem())
+		}
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(Tx{Value: sample.Interface()})
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %w", t, err)
+		}
+		probes = append(probes, typeProbe{Name: t.String(), Sample: buf.Bytes()})
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].Name < probes[j].Name })
+	return probes, nil
+}
+
+// checkTypes makes sure every probed type is registered with gob, and
+// otherwise fails with ErrUnregisteredType naming the types that are not.
+// A sample is a zero value the store encoded itself, so decoding it fails
+// when gob has no type registered under its name, or one that can't read it
+// back, and either way the dump can't be loaded. Which of the two it was
+// isn't told apart, gob only says so in the wording of its error.
+func checkTypes(probes []typeProbe) error {
+	var missing []string
+	for _, p := range probes {
+		var tx Tx
+		err := gob.NewDecoder(bytes.NewReader(p.Sample)).Decode(&tx)
+		if err != nil {
+			missing = append(missing, p.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s, call gob.Register with a value of each before opening the store",
+			ErrUnregisteredType, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WALSize returns the size of the journal in bytes, including what is still
+// buffered and not yet written to the file.
+func (kv *KV) WALSize() (int64, error) {
+	if !kv.ready.Load() {
+		return 0, ErrClosed
+	}
+	if kv.readOnly {
+		return 0, nil
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.journal.size(), nil
+}
+
+// Record is a single record in a journal, as returned by ReadWAL.
+type Record struct {
+	Op      Op
+	Key     string
+	Value   any       // the value set, nil unless Op is OpSet
+	Expires time.Time // when the key expires, zero if it doesn't
+	Label   string    // the label of an OpCheckpoint, see Checkpoint
+	Time    time.Time // when an OpCheckpoint was written
+	Seq     uint64    // sequence number of the record, 0 in journals from before they were numbered
+}
+
+// ReadWAL reads a journal and returns its records in the order they were
+// written, checking their checksums like a replay does. The types of the
+// values must be registered with gob, as for the store itself. Encrypted
+// journals can't be read and give ErrWrongKey. Journals with a checksum
+// seed are read with the seed in their header. On a corrupt journal the
+// records read so far are returned along with the error.
+func ReadWAL(r io.Reader) ([]Record, error) {
+	var records []Record
+	_, err := playReader(r, -1, "", journalConfig{anySeed: true}, func(op Op, tx Tx) {
+		records = append(records, Record{Op: op, Key: tx.Key, Value: tx.Value, Expires: tx.Expires, Label: tx.Label, Time: tx.Time, Seq: tx.seq})
+	})
+	return records, err
+}
+
+// ReplayOption configures ReplayWAL.
+type ReplayOption func(*replayOptions)
+
+type replayOptions struct {
+	key        []byte
+	corruption CorruptionPolicy
+	seed       uint32
+}
+
+// ReplayEncryption gives ReplayWAL the key of an encrypted journal.
+func ReplayEncryption(key []byte) ReplayOption {
+	return func(o *replayOptions) {
+		o.key = key
+	}
+}
+
+// ReplayCorruptionPolicy decides what ReplayWAL does about corrupt records,
+// like WithCorruptionPolicy does for a store. The default is PolicyAbort.
+func ReplayCorruptionPolicy(policy CorruptionPolicy) ReplayOption {
+	return func(o *replayOptions) {
+		o.corruption = policy
+	}
+}
+
+// ReplayChecksumSeed gives ReplayWAL the checksum seed the journal was
+// written with, see WithChecksumSeed.
+func ReplayChecksumSeed(seed uint32) ReplayOption {
+	return func(o *replayOptions) {
+		o.seed = seed
+	}
+}
+
+// ReplayWAL replays the journal at path onto into, the way it's replayed
+// when a store is opened, without opening a store. Sets and deletes are
+// applied in order, expiry deadlines are ignored. into is changed even if
+// replaying fails part way through.
+func ReplayWAL(path string, into map[string]any, opts ...ReplayOption) error {
+	var o replayOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg := journalConfig{corruption: o.corruption, seed: o.seed}
+	if o.key != nil {
+		c, err := newCrypter(o.key)
+		if err != nil {
+			return fmt.Errorf("encryption: %w", err)
+		}
+		cfg.crypt = c
+	}
+	m := kvMap(into)
+	_, err := play(path, &m, cfg)
+	return err
+}